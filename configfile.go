@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// settings that can come from -config, so one binary can be deployed to
+// several houses. JSON rather than YAML or TOML keeps us on the standard
+// library. anything given by flag or environment variable wins
+type fileConfig struct {
+	Broker   string   `json:"broker"`
+	Port     int      `json:"port"`
+	User     string   `json:"user"`
+	Password string   `json:"password"`
+	ClientID string   `json:"client_id"`
+	Topics   []string `json:"topics"`
+	// sound file (or directory) per action, on any topic
+	Sounds map[string]string `json:"sounds"`
+	// rules checked after any -sound flags, before the single and double sounds
+	SoundMap []soundRule `json:"sound_map"`
+	// as -volume and -gain
+	Volume *float64           `json:"volume"`
+	Gains  map[string]float64 `json:"gains"`
+	// where notifications go, as the flags of the same names
+	Slack        string   `json:"slack"`
+	Discord      string   `json:"discord"`
+	Ntfy         string   `json:"ntfy"`
+	Webhooks     []string `json:"webhooks"`
+	JSONWebhooks []string `json:"json_webhooks"`
+	// in the -hook form, e.g. "single=mqtt:porch/light/set=ON"
+	Hooks []string `json:"hooks"`
+	hooks hookList
+}
+
+func load_config_file(path string) (fileConfig, error) {
+	var f fileConfig
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return f, err
+	}
+	if err := json.Unmarshal(data, &f); err != nil {
+		return f, fmt.Errorf("%s: %v", path, err)
+	}
+	for i, r := range f.SoundMap {
+		if r.Topic == "" {
+			f.SoundMap[i].Topic = "#"
+		}
+		if r.Action == "" {
+			f.SoundMap[i].Action = "*"
+		}
+		if err := f.SoundMap[i].validate(); err != nil {
+			return f, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	for _, h := range f.Hooks {
+		if err := f.hooks.Set(h); err != nil {
+			return f, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return f, nil
+}
+
+// fill in whatever wasn't given on the command line or in the environment.
+// set holds the names of the flags given explicitly
+func (f fileConfig) apply(cfg *config, set map[string]bool) {
+	unset := func(name string, env string) bool {
+		_, in_env := os.LookupEnv(env)
+		return !set[name] && !in_env
+	}
+	if f.Broker != "" && unset("broker", BROKER_ENV_VAR) {
+		cfg.Broker = f.Broker
+	}
+	if f.Port != 0 && unset("port", PORT_ENV_VAR) {
+		cfg.Port = f.Port
+	}
+	if f.User != "" && unset("mqtt-user", MQTT_USER_ENV_VAR) {
+		cfg.MQTTUser = f.User
+	}
+	if f.Password != "" && unset("mqtt-pass", MQTT_PASS_ENV_VAR) {
+		cfg.MQTTPass = f.Password
+	}
+	if f.ClientID != "" && !set["client-id"] {
+		cfg.ClientID = f.ClientID
+	}
+	if len(f.Topics) > 0 && unset("topic", TOPICS_ENV_VAR) {
+		cfg.Topics = f.Topics
+	}
+	if path, ok := f.Sounds["single"]; ok && unset("", SINGLE_SOUND_ENV_VAR) {
+		cfg.SingleSound = path
+	}
+	if path, ok := f.Sounds["double"]; ok && unset("", DOUBLE_SOUND_ENV_VAR) {
+		cfg.DoubleSound = path
+	}
+	if f.Volume != nil && !set["volume"] {
+		cfg.Volume = *f.Volume
+	}
+	for action, db := range f.Gains {
+		if _, ok := cfg.Gains[action]; !ok {
+			cfg.Gains[action] = db
+		}
+	}
+	if f.Slack != "" && !set["slack"] && !set["doslack"] {
+		cfg.SlackURL = f.Slack
+	}
+	if f.Discord != "" && !set["discord"] {
+		cfg.DiscordURL = f.Discord
+	}
+	if f.Ntfy != "" && !set["ntfy"] {
+		cfg.NtfyURL = f.Ntfy
+	}
+	if len(f.Webhooks) > 0 && !set["webhook"] {
+		cfg.Webhooks = f.Webhooks
+	}
+	if len(f.JSONWebhooks) > 0 && !set["json-webhook"] {
+		cfg.JSONWebhooks = f.JSONWebhooks
+	}
+	if len(f.hooks) > 0 && !set["hook"] {
+		cfg.Hooks = f.hooks
+	}
+	cfg.SoundMap = append(cfg.SoundMap, f.SoundMap...)
+	var actions []string
+	for action := range f.Sounds {
+		if action != "single" && action != "double" {
+			actions = append(actions, action)
+		}
+	}
+	sort.Strings(actions)
+	for _, action := range actions {
+		cfg.SoundMap = append(cfg.SoundMap, soundRule{Topic: "#", Action: action, Sound: f.Sounds[action]})
+	}
+}
+
+// fill in what the flags left to the environment and the -config file.
+// SIGHUP runs this again over the same flags, so cfg is copied rather than
+// added to
+func resolve_config(cfg config, path string, set map[string]bool) (config, error) {
+	gains := gainMap{}
+	for action, db := range cfg.Gains {
+		gains[action] = db
+	}
+	cfg.Gains = gains
+	cfg.SoundMap = append(soundMap(nil), cfg.SoundMap...)
+	// secrets come from the environment after parsing so -help doesn't print them
+	if cfg.MQTTPass == "" {
+		cfg.MQTTPass = os.Getenv(MQTT_PASS_ENV_VAR)
+	}
+	if cfg.MatrixToken == "" {
+		cfg.MatrixToken = os.Getenv(MATRIX_TOKEN_ENV_VAR)
+	}
+	if cfg.TelegramToken == "" {
+		cfg.TelegramToken = os.Getenv(TELEGRAM_TOKEN_ENV_VAR)
+	}
+	if cfg.PushoverToken == "" {
+		cfg.PushoverToken = os.Getenv(PUSHOVER_TOKEN_ENV_VAR)
+	}
+	if cfg.NtfyToken == "" {
+		cfg.NtfyToken = os.Getenv(NTFY_TOKEN_ENV_VAR)
+	}
+	if cfg.HTTPToken == "" {
+		cfg.HTTPToken = os.Getenv(HTTP_TOKEN_ENV_VAR)
+	}
+	cfg.SingleSound = os.Getenv(SINGLE_SOUND_ENV_VAR)
+	cfg.DoubleSound = os.Getenv(DOUBLE_SOUND_ENV_VAR)
+	if path != "" {
+		file, err := load_config_file(path)
+		if err != nil {
+			return cfg, err
+		}
+		file.apply(&cfg, set)
+	}
+	if len(cfg.Topics) == 0 {
+		if env := os.Getenv(TOPICS_ENV_VAR); env != "" {
+			cfg.Topics = strings.Split(env, ",")
+		} else {
+			cfg.Topics = DEFAULT_TOPICS
+		}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"time"
+)
+
+// a quiet period after each accepted press that grows while presses keep
+// coming: base, then base*multiplier, and so on up to max. the streak starts
+// over once nobody has pressed for the reset period
+type cooldown struct {
+	Base       time.Duration
+	Multiplier float64
+	Max        time.Duration
+	Reset      time.Duration
+
+	last    time.Time
+	current time.Duration
+	streak  int
+}
+
+// whether a press at now gets through, recording it if it does
+func (c *cooldown) allow(now time.Time) bool {
+	if c.Base <= 0 {
+		return true
+	}
+	if !c.last.IsZero() && now.Sub(c.last) < c.current {
+		return false
+	}
+	if c.last.IsZero() || now.Sub(c.last) >= c.Reset {
+		c.streak = 0
+	} else {
+		c.streak++
+	}
+	c.current = c.Base
+	for i := 0; i < c.streak && (c.Max <= 0 || c.current < c.Max); i++ {
+		c.current = time.Duration(float64(c.current) * c.Multiplier)
+	}
+	if c.Max > 0 && c.current > c.Max {
+		c.current = c.Max
+	}
+	c.last = now
+	return true
+}
+
+// start the current cooldown over from now. receiver calls this when a
+// press's sound finishes, so the quiet period follows the chime rather than
+// running out while it's still playing
+func (c *cooldown) restart(now time.Time) {
+	if c.Base <= 0 || c.last.IsZero() {
+		return
+	}
+	c.last = now
+}
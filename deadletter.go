@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// a file of messages that couldn't be turned into a ring, one JSON object per line
+type deadletter struct {
+	Path string
+	// once the file would grow past this many bytes it's moved to Path.1
+	MaxSize int64
+}
+
+type deadletterEntry struct {
+	Time    time.Time `json:"time"`
+	Topic   string    `json:"topic"`
+	Payload string    `json:"payload"`
+	Reason  string    `json:"reason"`
+}
+
+// record a rejected message. does nothing when no path is configured
+func (d *deadletter) record(topic string, payload []byte, reason string) {
+	if d == nil || d.Path == "" {
+		return
+	}
+	line, err := json.Marshal(deadletterEntry{time.Now(), topic, string(payload), reason})
+	if err != nil {
+		slog.Warn("couldn't encode dead letter", "err", err)
+		return
+	}
+	line = append(line, '\n')
+	d.rotate(int64(len(line)))
+	f, err := os.OpenFile(d.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		slog.Warn("couldn't open dead letter file", "path", d.Path, "err", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(line); err != nil {
+		slog.Warn("couldn't write dead letter", "path", d.Path, "err", err)
+	}
+}
+
+// move the current file aside if adding incoming bytes would take it over the limit
+func (d *deadletter) rotate(incoming int64) {
+	if err := rotate_file(d.Path, d.MaxSize, incoming); err != nil {
+		slog.Warn("couldn't rotate dead letter file", "path", d.Path, "err", err)
+	}
+}
+
+// move path to path.1, replacing any older one, if adding incoming bytes
+// would take it past max_size. a max_size of zero never rotates
+func rotate_file(path string, max_size int64, incoming int64) error {
+	if max_size <= 0 {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Size()+incoming <= max_size {
+		return nil
+	}
+	return os.Rename(path, path+".1")
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/faiface/beep/speaker"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// how long any one doctor check may take
+const doctor_timeout = 10 * time.Second
+
+// run every check, print a pass/fail line for each and return the exit status
+func doctor(cfg config) int {
+	failures := 0
+	check := func(name string, err error) {
+		if err != nil {
+			failures++
+			fmt.Printf("FAIL %s: %v\n", name, err)
+		} else {
+			fmt.Printf("ok   %s\n", name)
+		}
+	}
+
+	type soundSource struct {
+		source   string
+		path     string
+		required bool
+	}
+	sounds := []soundSource{
+		{SINGLE_SOUND_ENV_VAR, cfg.SingleSound, len(cfg.SoundMap) == 0},
+		{DOUBLE_SOUND_ENV_VAR, cfg.DoubleSound, len(cfg.SoundMap) == 0},
+		{"-startup-sound", cfg.StartupSound, false},
+		{"-shutdown-sound", cfg.ShutdownSound, false},
+		{"-rapid-sound", cfg.RapidSound, false},
+		{"-combo-sound", cfg.ComboSound, false},
+	}
+	speaker_err := fmt.Errorf("no sound decoded to take a sample rate from")
+	speaker_tried := false
+	for _, r := range cfg.SoundMap {
+		sounds = append(sounds, soundSource{"-sound " + r.Topic + ":" + r.Action, r.Sound, true})
+	}
+	for _, sound := range sounds {
+		source, path := sound.source, sound.path
+		if path == "" {
+			if sound.required {
+				check("sound "+source, fmt.Errorf("not set"))
+			}
+			continue
+		}
+		if is_url(path) {
+			local, err := fetch_sound(path, cfg.SoundCache)
+			if err != nil {
+				check(fmt.Sprintf("sound %s (%s)", source, path), err)
+				continue
+			}
+			path = local
+		}
+		paths := []string{path}
+		if entries, err := os.ReadDir(path); err == nil {
+			paths = nil
+			for _, entry := range entries {
+				if !entry.IsDir() && sound_extensions[strings.ToLower(filepath.Ext(entry.Name()))] {
+					paths = append(paths, filepath.Join(path, entry.Name()))
+				}
+			}
+			if len(paths) == 0 {
+				check(fmt.Sprintf("sound %s (%s)", source, path), fmt.Errorf("no sounds in directory"))
+			}
+		}
+		for _, path := range paths {
+			name := fmt.Sprintf("sound %s (%s)", source, path)
+			f, err := os.Open(path)
+			if err != nil {
+				check(name, err)
+				continue
+			}
+			streamer, format, err := decode_sound(path, f)
+			if err == nil {
+				streamer.Close()
+				if !speaker_tried {
+					speaker_err = speaker.Init(format.SampleRate, format.SampleRate.N(time.Second/10))
+					speaker_tried = true
+				}
+			} else {
+				f.Close()
+			}
+			check(name, err)
+		}
+	}
+	check("speaker", speaker_err)
+
+	opts := client_options(nil, nil, new_status(), cfg)
+	// a client ID of our own, so a running daemon doesn't get kicked off the broker
+	opts.SetClientID(opts.ClientID + "-doctor")
+	opts.OnConnect = nil
+	opts.OnConnectionLost = nil
+	opts.OnReconnecting = nil
+	// doctor going away says nothing about the daemon
+	opts.WillEnabled = false
+	opts.SetAutoReconnect(false)
+	opts.SetConnectRetry(false)
+	client := mqtt.NewClient(opts)
+	err := wait_token(client.Connect())
+	check("broker connect", err)
+	if err == nil {
+		for _, topic := range cfg.Topics {
+			// a refusal comes back as a successful SUBACK, so wait_token would
+			// miss it
+			check("subscribe "+topic, subscribe_one(client, topic, byte(cfg.QoS), nil))
+		}
+		client.Disconnect(250)
+	}
+
+	notifiers, err := make_notifiers(cfg)
+	check("notifier settings", err)
+	for _, n := range notifiers {
+		check("notifier "+n.Name(), reachable(n.Endpoint()))
+	}
+
+	if failures > 0 {
+		fmt.Printf("%d check(s) failed\n", failures)
+		return 1
+	}
+	fmt.Println("all checks passed")
+	return 0
+}
+
+// wait for an mqtt operation, giving up after doctor_timeout
+func wait_token(token mqtt.Token) error {
+	if !token.WaitTimeout(doctor_timeout) {
+		return fmt.Errorf("timed out")
+	}
+	return token.Error()
+}
+
+// whether anything answers HTTP at endpoint. any response at all counts, since
+// webhooks don't generally welcome requests that aren't a real delivery
+func reachable(endpoint string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), doctor_timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http_client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
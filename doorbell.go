@@ -1,68 +1,470 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"flag"
 	"fmt"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/faiface/beep"
+	"github.com/faiface/beep/effects"
 	"github.com/faiface/beep/flac"
 	"github.com/faiface/beep/mp3"
 	"github.com/faiface/beep/speaker"
-	"github.com/faiface/beep/wav"
-	"log"
+	"io/ioutil"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
-	"net/http"
-	"bytes"
-	"io/ioutil"
 )
 
 var SINGLE_SOUND_ENV_VAR = "DOORBELL_SINGLE_SOUND"
 var DOUBLE_SOUND_ENV_VAR = "DOORBELL_DOUBLE_SOUND"
+var SINGLE_VOLUME_ENV_VAR = "DOORBELL_SINGLE_VOLUME"
+var DOUBLE_VOLUME_ENV_VAR = "DOORBELL_DOUBLE_VOLUME"
+var MATRIX_TOKEN_ENV_VAR = "DOORBELL_MATRIX_TOKEN"
+var TELEGRAM_TOKEN_ENV_VAR = "DOORBELL_TELEGRAM_TOKEN"
+var PUSHOVER_TOKEN_ENV_VAR = "DOORBELL_PUSHOVER_TOKEN"
+var NTFY_TOKEN_ENV_VAR = "DOORBELL_NTFY_TOKEN"
+var HTTP_TOKEN_ENV_VAR = "DOORBELL_HTTP_TOKEN"
+var HISTORY_ENV_VAR = "DOORBELL_HISTORY"
+
+var BROKER_ENV_VAR = "DOORBELL_BROKER"
+var PORT_ENV_VAR = "DOORBELL_PORT"
+var TOPICS_ENV_VAR = "DOORBELL_TOPICS"
+var MQTT_USER_ENV_VAR = "DOORBELL_MQTT_USER"
+var MQTT_PASS_ENV_VAR = "DOORBELL_MQTT_PASS"
+
+// where the buttons publish, unless -topic or $DOORBELL_TOPICS say otherwise
+var DEFAULT_TOPICS = []string{"sensors/Doorbell", "sensors/Button"}
+
+// overridden at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+// exit status when -exit-on-connect-failure gives up on the broker,
+// so a supervisor can tell it apart from a crash
+const EXIT_CONNECT_FAILURE = 3
+
+// how long shutting down waits for the HTTP server and notifications in flight
+const shutdown_grace = 5 * time.Second
+
+// settings gathered from the command line
+type config struct {
+	Broker               string
+	Port                 int
+	Topics               stringList
+	SlackURL             string
+	SlackTimeout         time.Duration
+	NotifyTimeout        time.Duration
+	BufferSounds         bool
+	Repeat               int
+	HTTPAddr             string
+	HTTPToken            string
+	AckURL               string
+	DeadLetter           string
+	DeadLetterMaxSize    int64
+	Policies             policyList
+	Mixer                bool
+	MaxStreams           int
+	Gains                gainMap
+	ConnectRetries       int
+	ExitOnConnectFailure bool
+	SoundWait            time.Duration
+	MatrixHomeserver     string
+	MatrixRoom           string
+	MatrixToken          string
+	MatrixTimeout        time.Duration
+	HeartbeatTopic       string
+	HeartbeatInterval    time.Duration
+	ActionField          string
+	NotifyConcurrency    int
+	SlackBlocks          actionMap
+	Cooldown             time.Duration
+	CooldownMultiplier   float64
+	CooldownMax          time.Duration
+	CooldownReset        time.Duration
+	StartupSound         string
+	ShutdownSound        string
+	PlayGap              time.Duration
+	Proxy                string
+	NotifyDelays         durationMap
+	MaxSoundDuration     time.Duration
+	RapidSound           string
+	ComboSound           string
+	PressWindow          time.Duration
+	ModeTopic            string
+	MQTTUser             string
+	MQTTPass             string
+	MQTTTLS              bool
+	MQTTCA               string
+	Volume               float64
+	BatteryThreshold     int
+	DiscordURL           string
+	DiscordTimeout       time.Duration
+	Webhooks             stringList
+	WebhookTimeout       time.Duration
+	ReconnectInterval    time.Duration
+	ClientID             string
+	SingleSound          string
+	DoubleSound          string
+	MQTTCert             string
+	MQTTKey              string
+	MQTTInsecure         bool
+	SoundMap             soundMap
+	JSONWebhooks         stringList
+	TelegramToken        string
+	TelegramChat         string
+	TelegramTimeout      time.Duration
+	PushoverToken        string
+	PushoverUser         string
+	PushoverTimeout      time.Duration
+	NtfyURL              string
+	NtfyToken            string
+	NtfyTimeout          time.Duration
+	NotifyFor            actionMap
+	DNDTopic             string
+	History              string
+	HistoryMaxSize       int64
+	VolumeTopic          string
+	Busy                 string
+	Debounce             time.Duration
+	Announce             string
+	AnnounceOnly         bool
+	TTSCommand           string
+	BatteryHysteresis    int
+	LinkThreshold        int
+	LinkHysteresis       int
+	HADiscovery          bool
+	HAPrefix             string
+	HANode               string
+	Snapshots            snapshotSources
+	SnapshotTimeout      time.Duration
+	Outputs              stringList
+	RingTopic            string
+	Hooks                hookList
+	HookTimeout          time.Duration
+	Simulate             bool
+	SimulateEvery        time.Duration
+	SimulateAction       string
+	NoAudio              bool
+	SoundCache           string
+	QoS                  int
+	CleanSession         bool
+	AvailabilityTopic    string
+	Presence             stringList
+	PresencePing         stringList
+	PresenceInterval     time.Duration
+	PresenceTimeout      time.Duration
+	NotifyWhen           actionMap
+}
 
 type player struct {
 	streamer beep.StreamSeekCloser
+	buffer   *beep.Buffer
 	Path     string
+	// decode the whole file into memory so playback never goes back to disk
+	Buffered bool
+	// how long to keep retrying if the file can't be opened yet
+	Wait time.Duration
+	// volume in decibels, applied with effects.Volume: zero leaves the
+	// sound as it is, positive is louder and negative quieter
+	Volume float64
+	// cut playback off after this long; zero plays the whole file
+	MaxDuration time.Duration
+	format      beep.Format
+	// when Path is a directory, a player for each sound in it
+	choices []*player
+	// where Path is downloaded to when it's a URL
+	Cache string
+}
+
+// files we know how to decode
+var sound_extensions = map[string]bool{".wav": true, ".flac": true, ".mp3": true, ".ogg": true, ".oga": true, ".opus": true}
+
+// picks between a directory's sounds. players are used from several
+// goroutines, and a rand.Rand isn't safe for that on its own
+var chooser = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// the range of gains we'll apply, so a typo can't blow the speakers
+const min_gain_db = -40.0
+const max_gain_db = 12.0
+
+// limit a gain to the safe range
+func clamp_gain(db float64) float64 {
+	if db < min_gain_db {
+		return min_gain_db
+	}
+	if db > max_gain_db {
+		return max_gain_db
+	}
+	return db
+}
+
+// the sample rate the speaker was initialised with, once it has been
+var output_rate beep.SampleRate
+
+// false if the speaker couldn't be initialised, in which case playing
+// finishes straight away
+var speaker_ready bool
+
+// from -no-audio: the speaker is left alone and sounds are only timed
+var no_audio bool
+
+// open a sound file, retrying until the wait runs out.
+// each attempt runs in its own goroutine so a hung network mount
+// can't block startup past the deadline
+func open_sound(path string, wait time.Duration) (*os.File, error) {
+	type attempt struct {
+		f   *os.File
+		err error
+	}
+	deadline := time.Now().Add(wait)
+	for {
+		result := make(chan attempt, 1)
+		go func() {
+			f, err := os.Open(path)
+			result <- attempt{f, err}
+		}()
+		remaining := time.Until(deadline)
+		if remaining < time.Second {
+			remaining = time.Second
+		}
+		var err error
+		select {
+		case a := <-result:
+			if a.err == nil {
+				return a.f, nil
+			}
+			err = a.err
+		case <-time.After(remaining):
+			err = fmt.Errorf("timed out opening file")
+		}
+		if !time.Now().Before(deadline) {
+			return nil, fmt.Errorf("sound file %s still unavailable after %v: %v", path, wait, err)
+		}
+		slog.Warn("sound file not available yet, retrying", "path", path, "err", err)
+		time.Sleep(time.Second)
+	}
+}
+
+// pick a decoder by file extension
+func decode_sound(path string, f *os.File) (beep.StreamSeekCloser, beep.Format, error) {
+	extension := strings.ToLower(filepath.Ext(path))
+	if extension == ".wav" {
+		return decode_wav(f)
+	} else if extension == ".flac" {
+		return flac.Decode(f)
+	} else if extension == ".mp3" {
+		return mp3.Decode(f)
+	} else if extension == ".ogg" || extension == ".oga" || extension == ".opus" {
+		return decode_transcoded(f)
+	}
+	return nil, beep.Format{}, fmt.Errorf("unrecognised file extension %s", extension)
 }
 
 // initialise a sound player
-func (p *player) init() {
+func (p *player) init() error {
 	var err error
 	var format beep.Format
 
-	f, err := os.Open(p.Path)
+	local := p.Path
+	if is_url(p.Path) {
+		if local, err = fetch_sound(p.Path, p.Cache); err != nil {
+			return err
+		}
+	}
+	f, err := open_sound(local, p.Wait)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	if info, err := f.Stat(); err == nil && info.IsDir() {
+		return p.init_dir(f)
 	}
 
-	extension := filepath.Ext(p.Path)
+	p.streamer, format, err = decode_sound(local, f)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("%s: %v", p.Path, err)
+	}
+	if p.Buffered {
+		p.buffer = beep.NewBuffer(format)
+		p.buffer.Append(p.streamer)
+		p.streamer.Close()
+		p.streamer = nil
+		slog.Debug("buffered in memory", "path", p.Path)
+	}
+	p.format = format
+	if p.MaxDuration > 0 {
+		length := p.length()
+		if limit := format.SampleRate.N(p.MaxDuration); length > limit {
+			slog.Warn("sound will be cut off", "path", p.Path, "length", format.SampleRate.D(length), "max", p.MaxDuration)
+		}
+	}
+	slog.Info("initialising stream", "path", p.Path)
+	// the first sound decoded sets the speaker's rate; the rest are resampled to it
+	if output_rate == 0 {
+		output_rate = format.SampleRate
+		if no_audio {
+			slog.Info("no audio: sounds are timed but not played")
+		} else if err := speaker.Init(output_rate, output_rate.N(time.Second/10)); err != nil {
+			// notifications are still worth sending with nothing to play on
+			slog.Warn("couldn't initialise the speaker, sounds won't play", "err", err)
+		} else {
+			speaker_ready = true
+			slog.Info("speaker running", "rate_hz", int(output_rate))
+		}
+	} else if format.SampleRate != output_rate {
+		slog.Info("resampling", "path", p.Path, "from_hz", int(format.SampleRate), "to_hz", int(output_rate))
+	}
+	return nil
+}
 
-	if extension == ".wav" {
-		p.streamer, format, err = wav.Decode(f)
-	} else if extension == ".flac" {
-		p.streamer, format, err = flac.Decode(f)
-	} else if extension == ".mp3" {
-		p.streamer, format, err = mp3.Decode(f)
-	} else {
-		log.Printf("unrecognised file extension %s\n", extension)
-		os.Exit(1)
+// release the file behind a streaming player
+func (p *player) close() {
+	for _, choice := range p.choices {
+		choice.close()
 	}
+	if p.streamer != nil {
+		p.streamer.Close()
+	}
+}
 
+// set up a player for every sound in a directory, one of which
+// is picked at random each time this one plays
+// a sound in it that won't load is skipped, as long as one does
+func (p *player) init_dir(dir *os.File) error {
+	entries, err := dir.ReadDir(-1)
+	dir.Close()
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("couldn't read sound directory %s: %v", p.Path, err)
 	}
-	log.Printf("initialising stream for file %s\n", p.Path)
-	speaker.Init(format.SampleRate, format.SampleRate.N(time.Second/10))
+	for _, entry := range entries {
+		if entry.IsDir() || !sound_extensions[strings.ToLower(filepath.Ext(entry.Name()))] {
+			continue
+		}
+		// only the settings are shared, not what's been loaded so far
+		choice := &player{
+			Path:        filepath.Join(p.Path, entry.Name()),
+			Buffered:    p.Buffered,
+			Wait:        p.Wait,
+			Volume:      p.Volume,
+			MaxDuration: p.MaxDuration,
+			Cache:       p.Cache,
+		}
+		if err := choice.init(); err != nil {
+			slog.Warn("skipping sound", "err", err)
+			continue
+		}
+		p.choices = append(p.choices, choice)
+	}
+	if len(p.choices) == 0 {
+		return fmt.Errorf("no playable .wav, .flac, .mp3, .ogg or .opus files in sound directory %s", p.Path)
+	}
+	slog.Info("sounds to choose from", "path", p.Path, "count", len(p.choices))
+	return nil
 }
 
-// play a sound
-func (p *player) play(done chan<- bool) {
-	p.streamer.Seek(0)
-	speaker.Play(beep.Seq(p.streamer, beep.Callback(func() {
-		done <- true
-	})))
+// length of the sound in samples
+func (p *player) length() int {
+	if p.buffer != nil {
+		return p.buffer.Len()
+	}
+	return p.streamer.Len()
+}
+
+// the player that actually sounds: itself, or for a directory one of
+// its sounds at random
+func (p *player) pick() *player {
+	if len(p.choices) == 0 {
+		return p
+	}
+	chooser.Lock()
+	choice := p.choices[chooser.Intn(len(p.choices))]
+	chooser.Unlock()
+	return choice.pick()
+}
+
+// play a sound with gain extra decibels on top of its own volume,
+// calling finished once it's done
+func (p *player) play(gain float64, finished func()) {
+	if len(p.choices) > 0 {
+		p.pick().play(gain, finished)
+		return
+	}
+	if no_audio {
+		length := p.format.SampleRate.D(p.length())
+		if p.MaxDuration > 0 && length > p.MaxDuration {
+			length = p.MaxDuration
+		}
+		slog.Debug("playing silently", "path", p.Path, "length", length)
+		time.AfterFunc(length, finished)
+		return
+	}
+	if !speaker_ready {
+		finished()
+		return
+	}
+	var s beep.Streamer
+	if p.buffer != nil {
+		s = p.buffer.Streamer(0, p.buffer.Len())
+	} else {
+		p.streamer.Seek(0)
+		s = p.streamer
+	}
+	if p.MaxDuration > 0 {
+		s = beep.Take(p.format.SampleRate.N(p.MaxDuration), s)
+	}
+	if p.format.SampleRate != output_rate {
+		s = beep.Resample(4, p.format.SampleRate, output_rate, s)
+	}
+	if volume := clamp_gain(p.Volume + gain); volume != 0 {
+		// effects.Volume multiplies by Base^Volume, so base 10 and dB/20 gives a gain in decibels
+		s = &effects.Volume{Streamer: s, Base: 10, Volume: volume / 20}
+	}
+	speaker.Play(beep.Seq(s, beep.Callback(finished)))
+}
+
+// what to do with a press that comes in while the chime is already going
+const (
+	// ignore it, sound and notification alike
+	busy_drop = "drop"
+	// play it once the current sound finishes
+	busy_queue = "queue"
+	// stop the current sound and play the new one
+	busy_interrupt = "interrupt"
+)
+
+// presses waiting for -busy=queue beyond this are not played
+const max_queued = 10
+
+// one press's worth of sound, which may be repeated
+type playback struct {
+	p *player
+	// plays left after the current one; negative repeats until acknowledged
+	remaining int
+	// decibels on top of the player's volume, from a quiet hours policy
+	// and the runtime adjustment
+	gain float64
+	// the press it's for; empty for sounds that aren't for a press
+	topic  string
+	action string
+	// when it first started, repeats and all
+	started time.Time
 }
 
 type ButtonMessage struct {
@@ -70,6 +472,86 @@ type ButtonMessage struct {
 	Battery     uint16
 	Lastseen    uint64
 	Linkquality uint16
+	// newer zigbee2mqtt versions can report these under a nested device object
+	Device *deviceInfo
+}
+
+type deviceInfo struct {
+	Battery     uint16
+	Linkquality uint16
+}
+
+// fill in battery and link quality from the nested device object
+// when the top level doesn't carry them
+func (m *ButtonMessage) flatten() {
+	if m.Device == nil {
+		return
+	}
+	if m.Battery == 0 {
+		m.Battery = m.Device.Battery
+	}
+	if m.Linkquality == 0 {
+		m.Linkquality = m.Device.Linkquality
+	}
+}
+
+// unpack a button message, taking the action from field, which may be a
+// dotted path such as data.action for payloads that nest it
+func parse_button(payload []byte, field string) (ButtonMessage, error) {
+	var m ButtonMessage
+	if err := json.Unmarshal(payload, &m); err != nil {
+		return m, err
+	}
+	if !strings.EqualFold(field, "action") {
+		var err error
+		if m.Action, err = extract_action(payload, field); err != nil {
+			return m, err
+		}
+	}
+	m.flatten()
+	return m, nil
+}
+
+// pull the action out of a payload that keeps it under some other key
+func extract_action(payload []byte, field string) (string, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return "", err
+	}
+	var value interface{} = fields
+	for _, key := range strings.Split(field, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return "", nil
+		}
+		value = object[key]
+	}
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+// split a payload holding a JSON array into its elements. anything else,
+// including JSON that doesn't parse, is passed along whole
+func split_batch(payload []byte) [][]byte {
+	trimmed := bytes.TrimSpace(payload)
+	if len(trimmed) == 0 || trimmed[0] != '[' {
+		return [][]byte{payload}
+	}
+	var elements []json.RawMessage
+	if err := json.Unmarshal(trimmed, &elements); err != nil {
+		return [][]byte{payload}
+	}
+	batch := make([][]byte, len(elements))
+	for i, e := range elements {
+		batch[i] = e
+	}
+	return batch
 }
 
 // closure which creates a messages handler
@@ -80,147 +562,1047 @@ func make_listener(button chan<- mqtt.Message) mqtt.MessageHandler {
 	}
 }
 
+// a notification held back by -notify-delay
+type delayedEvent struct {
+	ev    Event
+	timer *time.Timer
+}
+
 // coordinate receiving messages and then playing the appropriate sound
-func receiver(button <-chan mqtt.Message, finished chan<- bool, slack_url string) {
-	playing := false
-	single_path := os.Getenv(SINGLE_SOUND_ENV_VAR)
-	double_path := os.Getenv(DOUBLE_SOUND_ENV_VAR)
-	sp := player{Path: single_path}
-	dp := player{Path: double_path}
-	sp.init()
-	dp.init()
-	player_channel := make(chan bool)
+func receiver(button <-chan mqtt.Message, acks <-chan bool, reloads <-chan settings, finished chan<- bool, st *status, ha *homeAssistant, outputs []output, loaded settings) {
+	cfg, sounds, speech, hooks := loaded.cfg, loaded.sounds, loaded.speech, loaded.hooks
+	// everything currently sounding. the speaker mixes whatever it's given
+	// (speaker.Play adds to its own beep.Mixer) so all that separates
+	// serialized and mixer modes is how many of these are allowed at once
+	playbacks := make(map[*playback]bool)
+	max_playbacks := 1
+	if cfg.Mixer && cfg.MaxStreams > 1 {
+		max_playbacks = cfg.MaxStreams
+	}
+	notifiers := loaded.notifiers
+	cool := &cooldown{
+		Base:       cfg.Cooldown,
+		Multiplier: cfg.CooldownMultiplier,
+		Max:        cfg.CooldownMax,
+		Reset:      cfg.CooldownReset,
+	}
+	dispatch := new_dispatcher(cfg.NotifyConcurrency, cfg.NotifyTimeout, st)
+	dead := &deadletter{Path: cfg.DeadLetter, MaxSize: cfg.DeadLetterMaxSize}
+	presses := &history{Path: cfg.History, MaxSize: cfg.HistoryMaxSize}
+	classifier := &pressClassifier{Window: cfg.PressWindow}
+	// sounds replaced by a reload, kept open until nothing could still be
+	// playing one of them
+	var retired []*soundSet
+	player_channel := make(chan *playback)
+	// plays started that haven't called back on player_channel yet
+	ringing := 0
+	// closed on shutdown, so nothing in the background is left blocked
+	// handing receiver something it will never take
+	quit := make(chan struct{})
+	// hooks, announcements and snapshots still going, for shutdown to wait on
+	var background sync.WaitGroup
+	start := func(pb *playback) {
+		if pb.started.IsZero() {
+			pb.started = time.Now()
+		}
+		ringing++
+		ring_all(outputs, pb, func() {
+			player_channel <- pb
+		})
+	}
+	// once a play and any gap after it are over, repeat it or free its slot
+	// for whatever's been queued
+	gaps := make(chan *playback)
+	var queued []*playback
+	release := func() {
+		if len(playbacks) > 0 || len(queued) > 0 {
+			return
+		}
+		for _, old := range retired {
+			old.close()
+		}
+		retired = nil
+	}
+	next := func(pb *playback) {
+		if pb.remaining != 0 {
+			if pb.remaining > 0 {
+				pb.remaining--
+			}
+			start(pb)
+			return
+		}
+		slog.Info("finished dinging", "topic", pb.topic, "action", pb.action, "duration", time.Since(pb.started).Round(time.Millisecond))
+		delete(playbacks, pb)
+		cool.restart(time.Now())
+		if len(queued) > 0 && len(playbacks) < max_playbacks {
+			pb, queued = queued[0], queued[1:]
+			slog.Info("playing queued press", "topic", pb.topic, "action", pb.action, "waiting", len(queued))
+			playbacks[pb] = true
+			start(pb)
+		}
+		release()
+	}
+	// stop everything sounding to make way for a new press. callbacks for
+	// streamers the speaker drops never run, so their slots are freed here
+	interrupt := func() {
+		speaker.Clear()
+		for pb := range playbacks {
+			delete(playbacks, pb)
+		}
+		// nor will anything the speaker was playing ever call back
+		if speaker_ready && !no_audio {
+			ringing = 0
+		}
+		slog.Info("interrupted")
+	}
+	// play now if there's a free slot, otherwise make way when interrupting
+	// or wait for one
+	begin := func(pb *playback, interrupting bool) {
+		if len(playbacks) < max_playbacks {
+			playbacks[pb] = true
+			start(pb)
+		} else if interrupting {
+			interrupt()
+			playbacks[pb] = true
+			start(pb)
+		} else if len(queued) < max_queued {
+			queued = append(queued, pb)
+			slog.Info("queued behind what's playing", "topic", pb.topic, "action", pb.action, "waiting", len(queued))
+		} else {
+			slog.Warn("not playing: queue full", "topic", pb.topic, "action", pb.action)
+		}
+	}
+	if sounds.startup != nil {
+		pb := &playback{p: sounds.startup}
+		playbacks[pb] = true
+		start(pb)
+	}
+	send_all := func(ev Event) {
+		for _, n := range notifiers {
+			if !wants(n, ev) {
+				continue
+			}
+			if when := cfg.NotifyWhen[notifier_kind(n)]; !st.presence.allows(when) {
+				slog.Debug("not notifying", "notifier", notifier_kind(n), "action", ev.Action, "reason", "presence", "presence", st.presence.state(), "when", when)
+				continue
+			}
+			dispatch.send(n, ev)
+		}
+	}
+	// battery and link quality alerts, once per device until they recover
+	levels := new_monitor(cfg)
+	// announcements are rendered in the background and then wait their
+	// turn behind the chime
+	spoken := make(chan *playback)
+	// when each topic and action was last acted on, for -debounce
+	last_press := make(map[string]time.Time)
+	// notifications waiting out a -notify-delay. an ack or a mute cancels them
+	delayed := make(map[*delayedEvent]bool)
+	due := make(chan *delayedEvent)
+	// send now, or once the action's -notify-delay is up
+	queue_notification := func(ev Event) {
+		if delay := cfg.NotifyDelays[ev.Action]; delay > 0 {
+			d := &delayedEvent{ev: ev}
+			d.timer = time.AfterFunc(delay, func() {
+				select {
+				case due <- d:
+				case <-quit:
+				}
+			})
+			delayed[d] = true
+			return
+		}
+		send_all(ev)
+	}
+	// notifications whose camera snapshot has come back, or failed to,
+	// and how many are still waiting on the camera
+	snapped := make(chan Event)
+	snapping := 0
+	// handle one button message; batched publishes come through here once per element
+	handle := func(topic string, payload []byte) {
+		logger := slog.With("topic", topic)
+		buttonmessage, e := parse_button(payload, cfg.ActionField)
+		if e != nil {
+			logger.Warn("problem unpacking message", "err", e)
+			dead.record(topic, payload, fmt.Sprintf("invalid JSON: %v", e))
+			return
+		}
+		st.saw(topic, buttonmessage)
+		ha.battery(buttonmessage.Battery, buttonmessage.Linkquality)
+		for _, ev := range levels.check(topic, buttonmessage) {
+			send_all(ev)
+		}
+		if buttonmessage.Action == "" {
+			logger.Debug("ignoring message without an action", "battery", buttonmessage.Battery, "linkquality", buttonmessage.Linkquality)
+			return
+		}
+		logger = logger.With("action", buttonmessage.Action)
+		logger.Info("press", "battery", buttonmessage.Battery, "linkquality", buttonmessage.Linkquality)
+		st.pressed(buttonmessage.Action)
+		ha.pressed(buttonmessage.Action, topic)
+		presses.record(historyEntry{
+			Time:        time.Now(),
+			Topic:       topic,
+			Action:      buttonmessage.Action,
+			Battery:     buttonmessage.Battery,
+			Linkquality: buttonmessage.Linkquality,
+		})
+		if cfg.Debounce > 0 {
+			key := topic + "\x00" + buttonmessage.Action
+			if time.Since(last_press[key]) < cfg.Debounce {
+				logger.Info("ignored", "reason", "debounce")
+				return
+			}
+			last_press[key] = time.Now()
+		}
+		if len(playbacks) >= max_playbacks && cfg.Busy == busy_drop {
+			logger.Info("ignored", "reason", "already playing")
+			return
+		}
+		p := sounds.find(topic, buttonmessage.Action)
+		if p == nil {
+			dead.record(topic, payload, fmt.Sprintf("unknown action %q", buttonmessage.Action))
+			return
+		}
+		if !cool.allow(time.Now()) {
+			logger.Info("ignored", "reason", "cooldown")
+			return
+		}
+		class := classifier.classify(buttonmessage.Action, time.Now())
+		if cp, ok := sounds.class[class]; ok {
+			logger.Info("press class", "class", class)
+			p = cp
+		}
+		ev := Event{
+			Topic:       topic,
+			Action:      buttonmessage.Action,
+			Class:       class,
+			Battery:     buttonmessage.Battery,
+			Linkquality: buttonmessage.Linkquality,
+			Time:        time.Now(),
+			Text:        fmt.Sprintf("ding dong! (link quality %d; battery %d)", buttonmessage.Linkquality, buttonmessage.Battery),
+		}
+		if cfg.AckURL != "" {
+			ev.Text += fmt.Sprintf(" acknowledge: %s/ack", cfg.AckURL)
+		}
+		// hooks go with the press, so unlike the chime and notifications
+		// policies and do not disturb don't hold them back
+		hooks.fire(ev, &background)
+		pol, pol_index := cfg.Policies.current(time.Now())
+		play, notify_ok := pol.Play, pol.Notify
+		if st.dnd() {
+			logger.Info("not playing", "reason", "do not disturb")
+		} else if st.muted() {
+			logger.Info("not playing", "reason", "muted")
+		} else if play {
+			if pp, ok := sounds.policy[pol_index]; ok {
+				p = pp
+			}
+			gain := pol.Volume + st.volume()
+			if speech != nil {
+				data := announcement{ButtonMessage: buttonmessage, Topic: topic, Class: class, Time: time.Now()}
+				background.Add(1)
+				go func() {
+					defer background.Done()
+					voice, err := speech.render(data)
+					if err != nil {
+						logger.Warn("couldn't render announcement", "err", err)
+						return
+					}
+					select {
+					case spoken <- &playback{p: voice, gain: gain}:
+					case <-quit:
+						logger.Info("not announcing", "reason", "shutting down")
+					}
+				}()
+			}
+			if !cfg.AnnounceOnly || speech == nil {
+				begin(&playback{p: p, remaining: cfg.Repeat - 1, gain: gain, topic: topic, action: buttonmessage.Action}, cfg.Busy == busy_interrupt)
+			}
+		} else {
+			logger.Info("not playing", "reason", "policy")
+		}
+		if !notify_ok {
+			logger.Info("not notifying", "reason", "policy")
+			return
+		}
+		// the camera is asked in the background, so a slow one holds up
+		// only the notification and never the chime
+		if source := cfg.Snapshots.source(topic); source != "" {
+			snapping++
+			background.Add(1)
+			go func() {
+				defer background.Done()
+				ctx, cancel := context.WithTimeout(context.Background(), cfg.SnapshotTimeout)
+				defer cancel()
+				data, content_type, err := fetch_snapshot(ctx, source)
+				if err == nil {
+					ev.Snapshot, err = st.snapshots.add(data, content_type)
+				}
+				if err != nil {
+					logger.Warn("couldn't take snapshot", "err", err)
+				} else {
+					if cfg.AckURL != "" {
+						ev.Text += fmt.Sprintf(" snapshot: %s/snapshot/%s", cfg.AckURL, ev.Snapshot.ID)
+					}
+				}
+				select {
+				case snapped <- ev:
+				case <-quit:
+					logger.Warn("dropped notification", "reason", "shutting down")
+				}
+			}()
+			return
+		}
+		queue_notification(ev)
+	}
+	// what an ack or a mute puts a stop to: notifications still waiting out
+	// -notify-delay, and repeats. reports whether anything was repeating
+	silence := func() bool {
+		for d := range delayed {
+			d.timer.Stop()
+			delete(delayed, d)
+			slog.Info("cancelled delayed notification", "action", d.ev.Action)
+		}
+		repeating := false
+		for pb := range playbacks {
+			if pb.remaining != 0 {
+				repeating = true
+				pb.remaining = 0
+			}
+		}
+		return repeating
+	}
 	for {
 		select {
 		case msg, more := <-button:
 			if more {
-				log.Printf("received: %s\n", msg.Payload())
-				var buttonmessage ButtonMessage
-				e := json.Unmarshal(msg.Payload(), &buttonmessage)
-				if e != nil {
-					log.Println("problem unpacking message!")
-					continue
-				}
-				if buttonmessage.Action == "" {
-					log.Printf("ignoring empty message %s\n", buttonmessage.Action)
-					continue
+				slog.Debug("received", "topic", msg.Topic(), "payload", string(msg.Payload()))
+				for _, payload := range split_batch(msg.Payload()) {
+					handle(msg.Topic(), payload)
 				}
-				if playing {
-					log.Println("Already playing")
-					continue
+			} else {
+				slog.Info("done")
+				if sounds.shutdown != nil {
+					played := make(chan bool)
+					go sounds.shutdown.play(0, func() {
+						played <- true
+					})
+					// anything still sounding has to be able to finish too,
+					// or its callback would hold up the speaker
+				drain:
+					for {
+						select {
+						case <-played:
+							break drain
+						case <-player_channel:
+							ringing--
+						}
+					}
 				}
-				if buttonmessage.Action == "single" {
-					playing = true
-					go sp.play(player_channel)
-					if slack_url != "" {
-						message := fmt.Sprintf("ding dong! (link quality %d; battery %d)", buttonmessage.Linkquality, buttonmessage.Battery)
-						go slack_post(message, slack_url)
+				// everything from here on shares one bound, so a stuck
+				// camera, hook or notifier can't hold up the exit for long
+				deadline := time.Now().Add(shutdown_grace)
+				expired := make(chan struct{})
+				time.AfterFunc(shutdown_grace, func() {
+					close(expired)
+				})
+				// then wait for the rest, so nothing is left blocked on
+				// player_channel or playing once we've gone
+			sounding:
+				for ringing > 0 {
+					select {
+					case <-player_channel:
+						ringing--
+					case <-expired:
+						slog.Warn("gave up waiting for sounds to finish", "playing", ringing)
+						break sounding
 					}
-				} else if buttonmessage.Action == "double" {
-					playing = true
-					go dp.play(player_channel)
-					if slack_url != ""{
-						message := fmt.Sprintf("ding dong! (link quality %d; battery %d)", buttonmessage.Linkquality, buttonmessage.Battery)
-						go slack_post(message, slack_url)
+				}
+				// anything held back by -notify-delay goes now rather than never
+				for d := range delayed {
+					d.timer.Stop()
+					delete(delayed, d)
+					slog.Info("sending delayed notification now", "action", d.ev.Action, "reason", "shutting down")
+					send_all(d.ev)
+				}
+				// as do notifications still waiting on the camera
+			snapshots:
+				for snapping > 0 {
+					select {
+					case ev := <-snapped:
+						snapping--
+						send_all(ev)
+					case <-expired:
+						slog.Warn("gave up waiting for snapshots", "waiting", snapping)
+						break snapshots
 					}
 				}
-			} else {
-				log.Println("done")
+				// lets go of timers that have already fired, gaps and
+				// announcements, then waits for hooks and anything else
+				// still running
+				close(quit)
+				idle := make(chan struct{})
+				go func() {
+					background.Wait()
+					close(idle)
+				}()
+				select {
+				case <-idle:
+				case <-expired:
+					slog.Warn("gave up waiting for hooks and announcements to finish")
+				}
+				dispatch.wait(time.Until(deadline))
+				sounds.close()
+				for _, old := range retired {
+					old.close()
+				}
+				if speaker_ready {
+					speaker.Close()
+				}
 				finished <- true
 				return
 			}
-		case <-player_channel:
-			log.Println("finished dinging")
-			playing = false
+		case pb := <-player_channel:
+			ringing--
+			// interrupted while its goroutine was still starting it
+			if !playbacks[pb] {
+				continue
+			}
+			// hold the slot through the gap so nothing starts during the silence
+			if cfg.PlayGap > 0 {
+				time.AfterFunc(cfg.PlayGap, func() {
+					select {
+					case gaps <- pb:
+					case <-quit:
+					}
+				})
+				continue
+			}
+			next(pb)
+		case pb := <-spoken:
+			begin(pb, false)
+		case pb := <-gaps:
+			if playbacks[pb] {
+				next(pb)
+			}
+		case ev := <-snapped:
+			snapping--
+			queue_notification(ev)
+		case d := <-due:
+			// an ack may have got in between the timer firing and now
+			if delayed[d] {
+				delete(delayed, d)
+				send_all(d.ev)
+			}
+		case r := <-reloads:
+			// whatever's sounding carries on with the old players, which
+			// are closed once it's done
+			retired = append(retired, sounds)
+			sounds = r.sounds
+			cfg = r.cfg
+			notifiers = r.notifiers
+			cool.Base, cool.Multiplier, cool.Max, cool.Reset = cfg.Cooldown, cfg.CooldownMultiplier, cfg.CooldownMax, cfg.CooldownReset
+			dead.Path, dead.MaxSize = cfg.DeadLetter, cfg.DeadLetterMaxSize
+			presses.Path, presses.MaxSize = cfg.History, cfg.HistoryMaxSize
+			classifier.Window = cfg.PressWindow
+			levels.retune(cfg)
+			speech = r.speech
+			hooks = r.hooks
+			release()
+			slog.Info("reloaded configuration")
+		case <-acks:
+			if silence() {
+				slog.Info("acknowledged, stopping after this ding")
+			} else {
+				slog.Info("acknowledged")
+			}
+		case <-st.muted_now:
+			if silence() {
+				slog.Info("muted, stopping after this ding")
+			}
 		}
 	}
-	return
 }
 
 // call back functions to handle connecting to mqtt
-var connectHandler mqtt.OnConnectHandler = func(client mqtt.Client) {
-	log.Println("Connected")
-	sub(client)
+// paho runs this after every successful connect, reconnects included, and
+// with a clean session the broker has forgotten our subscriptions by then, so
+// subscribing again here restores them without doubling anything up.
+// handlers hold subscriptions with their own callback, such as -dnd-topic
+func make_connect_handler(handlers map[string]mqtt.MessageHandler, st *status, cfg config) mqtt.OnConnectHandler {
+	connects := 0
+	return func(client mqtt.Client) {
+		connects++
+		if connects == 1 {
+			slog.Info("connected")
+		} else {
+			slog.Info("reconnected", "connection", connects)
+			st.reconnected()
+		}
+		if cfg.AvailabilityTopic != "" {
+			go publish_availability(client, cfg, "online")
+		}
+		topics := make(map[string]mqtt.MessageHandler)
+		for _, topic := range st.topics() {
+			topics[topic] = nil
+		}
+		for topic, handler := range handlers {
+			topics[topic] = handler
+		}
+		subscribe(client, topics, byte(cfg.QoS))
+	}
 }
 
-var connectLostHandler mqtt.ConnectionLostHandler = func(client mqtt.Client, err error) {
-	log.Printf("Connect lost: %v\n", err)
+// retained, so whoever subscribes later still learns whether we're up
+func publish_availability(client mqtt.Client, cfg config, state string) {
+	token := client.Publish(cfg.AvailabilityTopic, byte(cfg.QoS), true, state)
+	if !token.WaitTimeout(time.Second) {
+		slog.Warn("couldn't publish availability: timed out", "topic", cfg.AvailabilityTopic, "state", state)
+	} else if token.Error() != nil {
+		slog.Warn("couldn't publish availability", "topic", cfg.AvailabilityTopic, "state", state, "err", token.Error())
+	}
+}
+
+var reconnectingHandler mqtt.ReconnectHandler = func(client mqtt.Client, opts *mqtt.ClientOptions) {
+	slog.Info("reconnecting")
+}
+
+func make_lost_handler(st *status) mqtt.ConnectionLostHandler {
+	return func(client mqtt.Client, err error) {
+		slog.Warn("connection lost", "err", err)
+		st.connection_lost()
+	}
 }
 
 // create the mqtt client we'll use to pick up messages
-func setup_client(listener mqtt.MessageHandler) mqtt.Client {
-	var broker = "192.168.0.100"
-	var port = 1883
+func setup_client(listener mqtt.MessageHandler, handlers map[string]mqtt.MessageHandler, st *status, cfg config) mqtt.Client {
+	client := mqtt.NewClient(client_options(listener, handlers, st, cfg))
+	connect(client, cfg)
+	return client
+}
+
+// options for talking to the broker
+func client_options(listener mqtt.MessageHandler, handlers map[string]mqtt.MessageHandler, st *status, cfg config) *mqtt.ClientOptions {
 	hostname, err := os.Hostname()
 	if err != nil {
-		panic(err)
+		slog.Warn("couldn't get the hostname for the client ID", "err", err)
+		hostname = "doorbell"
 	}
 	opts := mqtt.NewClientOptions()
-	opts.AddBroker(fmt.Sprintf("tcp://%s:%d", broker, port))
-	clientid := fmt.Sprintf("go_mqtt_client-%s", hostname)
-	log.Printf("using client ID: %s", clientid)
+	broker, secure, err := broker_url(cfg)
+	if err != nil {
+		fatal("bad broker", "err", err)
+	}
+	if secure {
+		opts.SetTLSConfig(tls_config(cfg))
+	}
+	opts.AddBroker(broker)
+	clientid := cfg.ClientID
+	if clientid == "" {
+		clientid = fmt.Sprintf("go_mqtt_client-%s", hostname)
+	}
+	slog.Info("using client ID", "client_id", clientid)
 	opts.SetClientID(clientid)
-	// opts.SetUsername("emqx")
-	// opts.SetPassword("public")
+	if cfg.MQTTUser != "" {
+		opts.SetUsername(cfg.MQTTUser)
+	}
+	if cfg.MQTTPass != "" {
+		opts.SetPassword(cfg.MQTTPass)
+	}
 	opts.SetDefaultPublishHandler(listener)
-	opts.OnConnect = connectHandler
-	opts.OnConnectionLost = connectLostHandler
-	client := mqtt.NewClient(opts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		panic(token.Error())
+	opts.SetCleanSession(cfg.CleanSession)
+	if cfg.AvailabilityTopic != "" {
+		opts.SetWill(cfg.AvailabilityTopic, "offline", byte(cfg.QoS), true)
 	}
-	return client
+	opts.OnConnect = make_connect_handler(handlers, st, cfg)
+	opts.OnConnectionLost = make_lost_handler(st)
+	opts.OnReconnecting = reconnectingHandler
+	opts.SetAutoReconnect(true)
+	opts.SetMaxReconnectInterval(cfg.ReconnectInterval)
+	// paho's own retrying would hide the attempts -exit-on-connect-failure counts
+	opts.SetConnectRetry(!cfg.ExitOnConnectFailure)
+	opts.SetConnectRetryInterval(cfg.ReconnectInterval)
+	return opts
 }
 
-// post a message to a Slack channel using a webhook
-func slack_post(message string, endpoint string) {
-	postBody, _ := json.Marshal(map[string]string{
-		"text": message,
-	})
-	messageBody := bytes.NewBuffer(postBody)
-	resp, err := http.Post(endpoint, "application/json", messageBody)
+// the usual MQTT ports, for when neither -broker nor -port gives one
+const mqtt_port = 1883
+const mqtts_port = 8883
+
+// -broker is normally a bare host, but it may be a URL such as
+// tls://host:8883, which sets the scheme and possibly the port too
+func broker_url(cfg config) (string, bool, error) {
+	host, port, secure := cfg.Broker, "", cfg.MQTTTLS
+	if strings.Contains(cfg.Broker, "://") {
+		u, err := url.Parse(cfg.Broker)
+		if err != nil {
+			return "", false, err
+		}
+		switch strings.ToLower(u.Scheme) {
+		case "tcp", "mqtt":
+		case "ssl", "tls", "mqtts":
+			secure = true
+		default:
+			return "", false, fmt.Errorf("unrecognised scheme %q in %s", u.Scheme, cfg.Broker)
+		}
+		host, port = u.Hostname(), u.Port()
+	}
+	if port == "" && cfg.Port != 0 {
+		port = strconv.Itoa(cfg.Port)
+	} else if port == "" && secure {
+		port = strconv.Itoa(mqtts_port)
+	} else if port == "" {
+		port = strconv.Itoa(mqtt_port)
+	}
+	scheme := "tcp"
+	if secure {
+		scheme = "ssl"
+	}
+	return fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(host, port)), secure, nil
+}
+
+// TLS settings for the broker, trusting the CA in ca_path as well as the
+// system roots when one is given
+func tls_config(cfg config) *tls.Config {
+	conf := &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: cfg.MQTTInsecure}
+	if cfg.MQTTCert != "" || cfg.MQTTKey != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.MQTTCert, cfg.MQTTKey)
+		if err != nil {
+			fatal("couldn't load client certificate", "err", err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	ca_path := cfg.MQTTCA
+	if ca_path == "" {
+		return conf
+	}
+	pem, err := ioutil.ReadFile(ca_path)
 	if err != nil {
-		log.Fatalf("An Error Occured %v", err)
+		fatal("couldn't read CA certificate", "err", err)
 	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+	pool, err := x509.SystemCertPool()
 	if err != nil {
-		log.Fatalln(err)
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		fatal("no certificates found", "path", ca_path)
+	}
+	conf.RootCAs = pool
+	return conf
+}
+
+// connect to the broker, backing off between attempts. once the retries
+// are used up we either exit for a supervisor to handle or keep trying
+func connect(client mqtt.Client, cfg config) {
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		token := client.Connect()
+		if token.Wait() && token.Error() == nil {
+			return
+		}
+		slog.Warn("connect attempt failed", "attempt", attempt, "err", token.Error())
+		if attempt >= cfg.ConnectRetries && cfg.ExitOnConnectFailure {
+			slog.Error("giving up on the broker", "attempts", attempt)
+			os.Exit(EXIT_CONNECT_FAILURE)
+		}
+		time.Sleep(backoff)
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// periodically publish a liveness message so monitoring can notice if we stop
+func heartbeat(client mqtt.Client, topic string, interval time.Duration, st *status) {
+	for range time.Tick(interval) {
+		uptime, age := st.ages()
+		beat := map[string]interface{}{
+			"version":        version,
+			"uptime_seconds": int64(uptime.Seconds()),
+		}
+		if age >= 0 {
+			beat["last_message_age_seconds"] = int64(age.Seconds())
+		} else {
+			beat["last_message_age_seconds"] = nil
+		}
+		payload, _ := json.Marshal(beat)
+		token := client.Publish(topic, 0, false, payload)
+		if token.Wait() && token.Error() != nil {
+			slog.Warn("couldn't publish heartbeat", "topic", topic, "err", token.Error())
+		}
+	}
+}
+
+// keep a retained message on topic saying which mode we're in, publishing
+// at startup and again whenever the mode changes
+func publish_mode(client mqtt.Client, topic string, policies policyList, st *status) {
+	last := ""
+	for {
+		mode := policies.mode(time.Now(), st.dnd(), st.muted())
+		if mode != last {
+			token := client.Publish(topic, 1, true, mode)
+			if token.Wait() && token.Error() != nil {
+				slog.Warn("couldn't publish mode", "topic", topic, "err", token.Error())
+			} else {
+				slog.Info("mode", "mode", mode)
+				last = mode
+			}
+		}
+		// policies change on the minute, so this catches each transition
+		// promptly. do not disturb and muting wake us straight away
+		select {
+		case <-time.After(15 * time.Second):
+		case <-st.mode_changed:
+		}
 	}
-	log.Printf("message from Slack: %s", body)
 }
 
-// subscribe to the appropriate mqtt topic
-func sub(client mqtt.Client) {
-	topic := "sensors/Doorbell"
-	token := client.Subscribe(topic, 1, nil)
-	token.Wait()
-	topic = "sensors/Button"
-	token = client.Subscribe(topic, 1, nil)
-	token.Wait()
-	log.Printf("Subscribed to topic :%s\n", topic)
+// how long the broker has to acknowledge a subscription before it's retried
+const subscribe_timeout = 10 * time.Second
+
+// subscribe to the button topics, leaving their messages to the listener
+func sub(client mqtt.Client, topics []string, qos byte) {
+	listened := make(map[string]mqtt.MessageHandler)
+	for _, topic := range topics {
+		listened[topic] = nil
+	}
+	subscribe(client, listened, qos)
+}
+
+// subscribe to each topic, retrying any the broker times out or refuses
+// for as long as the connection stays up. otherwise one lost SUBACK after
+// a broker restart would leave us connected but deaf until the next
+// reconnect. a nil handler leaves messages to the default publish handler
+func subscribe(client mqtt.Client, topics map[string]mqtt.MessageHandler, qos byte) {
+	for len(topics) > 0 {
+		failed := make(map[string]mqtt.MessageHandler)
+		for topic, handler := range topics {
+			if err := subscribe_one(client, topic, qos, handler); err != nil {
+				slog.Warn("couldn't subscribe", "topic", topic, "qos", qos, "err", err)
+				failed[topic] = handler
+				continue
+			}
+			slog.Info("subscribed", "topic", topic, "qos", qos)
+		}
+		// the next connect subscribes to everything again anyway
+		if len(failed) == 0 || !client.IsConnectionOpen() {
+			return
+		}
+		time.Sleep(5 * time.Second)
+		topics = failed
+	}
+}
+
+func subscribe_one(client mqtt.Client, topic string, qos byte, handler mqtt.MessageHandler) error {
+	token := client.Subscribe(topic, qos, handler)
+	if !token.WaitTimeout(subscribe_timeout) {
+		return fmt.Errorf("timed out")
+	}
+	if err := token.Error(); err != nil {
+		return err
+	}
+	// 0x80 in the SUBACK is the broker saying no, e.g. to an ACL
+	if t, ok := token.(*mqtt.SubscribeToken); ok && t.Result()[topic] == 0x80 {
+		return fmt.Errorf("refused by the broker")
+	}
+	return nil
 }
 
 func main() {
-	_, single_present := os.LookupEnv(SINGLE_SOUND_ENV_VAR)
-	_, double_present := os.LookupEnv(DOUBLE_SOUND_ENV_VAR)
-	if !single_present || !double_present {
-		fmt.Printf("need to define %s and %s\n", SINGLE_SOUND_ENV_VAR, DOUBLE_SOUND_ENV_VAR)
+	if len(os.Args) > 1 && os.Args[1] == "history" {
+		os.Exit(history_command(os.Args[2:]))
+	}
+	cfg := config{Gains: gainMap{}, SlackBlocks: actionMap{}, NotifyDelays: durationMap{}, NotifyFor: actionMap{}, NotifyWhen: actionMap{}, Snapshots: snapshotSources{}}
+	flag.StringVar(&cfg.Broker, "broker", env_or(BROKER_ENV_VAR, "192.168.0.100"), fmt.Sprintf("MQTT broker host, or a URL such as tls://host:8883 (defaults to $%s)", BROKER_ENV_VAR))
+	flag.IntVar(&cfg.Port, "port", env_int(PORT_ENV_VAR, 0), fmt.Sprintf("MQTT broker port (defaults to $%s, otherwise 1883, or 8883 over TLS)", PORT_ENV_VAR))
+	flag.Var(&cfg.Topics, "topic", fmt.Sprintf("MQTT topic to listen on; repeatable (defaults to comma separated $%s, then %s)", TOPICS_ENV_VAR, strings.Join(DEFAULT_TOPICS, ", ")))
+	flag.StringVar(&cfg.MQTTUser, "mqtt-user", os.Getenv(MQTT_USER_ENV_VAR), fmt.Sprintf("MQTT username (defaults to $%s)", MQTT_USER_ENV_VAR))
+	flag.StringVar(&cfg.MQTTPass, "mqtt-pass", "", fmt.Sprintf("MQTT password; prefer $%s so it stays out of the process list", MQTT_PASS_ENV_VAR))
+	flag.BoolVar(&cfg.MQTTTLS, "mqtt-tls", false, "connect to the broker over TLS, on port 8883 unless -port says otherwise")
+	flag.StringVar(&cfg.MQTTCA, "mqtt-ca", "", "CA certificate to trust for the broker, e.g. for a self-signed one")
+	flag.StringVar(&cfg.MQTTCert, "mqtt-cert", "", "client certificate to present to the broker, with -mqtt-key")
+	flag.StringVar(&cfg.MQTTKey, "mqtt-key", "", "private key for -mqtt-cert")
+	flag.BoolVar(&cfg.MQTTInsecure, "mqtt-insecure", false, "don't verify the broker's certificate; only for testing")
+	flag.StringVar(&cfg.SlackURL, "doslack", "", "webhook for Slack messages (same as -slack)")
+	flag.StringVar(&cfg.SlackURL, "slack", "", "webhook for Slack messages")
+	flag.StringVar(&cfg.DiscordURL, "discord", "", "webhook for Discord messages")
+	flag.DurationVar(&cfg.DiscordTimeout, "discord-timeout", 0, "delivery timeout for Discord, overriding -notify-timeout")
+	flag.Var(&cfg.Webhooks, "webhook", "URL to POST each message to as plain text, e.g. an ntfy topic; repeatable")
+	flag.DurationVar(&cfg.WebhookTimeout, "webhook-timeout", 0, "delivery timeout for -webhook and -json-webhook, overriding -notify-timeout")
+	flag.DurationVar(&cfg.SlackTimeout, "slack-timeout", 0, "delivery timeout for Slack, overriding -notify-timeout")
+	flag.DurationVar(&cfg.NotifyTimeout, "notify-timeout", 10*time.Second, "default delivery timeout for notifications")
+	flag.BoolVar(&cfg.BufferSounds, "buffer-sounds", false, "decode sound files into memory at startup")
+	flag.DurationVar(&cfg.SoundWait, "sound-wait", 0, "how long to keep retrying sound files that can't be opened at startup")
+	syslogPtr := flag.Bool("log-syslog", false, "send log output to syslog instead of stderr")
+	levelPtr := flag.String("log-level", "info", "least severe messages to log: debug, info, warn or error")
+	formatPtr := flag.String("log-format", "text", "log as text or json")
+	facilityPtr := flag.String("syslog-facility", "daemon", "syslog facility to log under")
+	tagPtr := flag.String("syslog-tag", "doorbell", "syslog tag to log with")
+	flag.IntVar(&cfg.Repeat, "repeat", 1, "times to play the sound for each press; 0 repeats until acknowledged")
+	flag.StringVar(&cfg.HTTPAddr, "http-addr", "", "address to serve the HTTP endpoints on, e.g. :8080")
+	flag.StringVar(&cfg.HTTPToken, "http-token", "", fmt.Sprintf("token needed to ring, mute or change settings over HTTP, as a bearer token or ?token; reading, except snapshots, and /ack stay open (defaults to $%s)", HTTP_TOKEN_ENV_VAR))
+	flag.StringVar(&cfg.AckURL, "ack-url", "", "externally reachable base URL of the HTTP server, linked in notifications for acknowledging")
+	flag.StringVar(&cfg.DeadLetter, "deadletter", "", "file to record messages that couldn't be handled, as JSON lines")
+	flag.Int64Var(&cfg.DeadLetterMaxSize, "deadletter-max-size", 1<<20, "rotate the dead letter file once it reaches this many bytes; 0 never rotates")
+	flag.Var(&cfg.Policies, "policy", "time window policy such as 22:00-07:00=notify or sat,sun@21:00-07:30=play,notify,volume=-20 (sound=path swaps the chime); repeatable, first match wins")
+	flag.BoolVar(&cfg.Mixer, "mixer", false, "let presses layer their sounds over each other instead of dropping them while one plays")
+	flag.IntVar(&cfg.MaxStreams, "max-streams", 4, "most sounds to mix at once in -mixer mode")
+	flag.Float64Var(&cfg.Volume, "volume", 0, fmt.Sprintf("volume in dB for every sound; 0 is unchanged, negative quieter (overridden per sound by $%s and $%s)", SINGLE_VOLUME_ENV_VAR, DOUBLE_VOLUME_ENV_VAR))
+	flag.Var(cfg.Gains, "gain", "per-action gain in dB such as double=3, added to the volume; repeatable")
+	flag.IntVar(&cfg.ConnectRetries, "connect-retries", 5, "broker connection attempts before -exit-on-connect-failure gives up")
+	flag.BoolVar(&cfg.ExitOnConnectFailure, "exit-on-connect-failure", false, fmt.Sprintf("exit with status %d once -connect-retries is used up, rather than retrying forever", EXIT_CONNECT_FAILURE))
+	flag.StringVar(&cfg.MatrixHomeserver, "matrix-homeserver", "", "Matrix homeserver URL, e.g. https://matrix.example.org")
+	flag.StringVar(&cfg.MatrixRoom, "matrix-room", "", "Matrix room ID to post to")
+	flag.StringVar(&cfg.MatrixToken, "matrix-token", "", fmt.Sprintf("Matrix access token (defaults to $%s)", MATRIX_TOKEN_ENV_VAR))
+	flag.DurationVar(&cfg.MatrixTimeout, "matrix-timeout", 0, "delivery timeout for Matrix, overriding -notify-timeout")
+	flag.StringVar(&cfg.HeartbeatTopic, "heartbeat-topic", "", "MQTT topic to publish a periodic heartbeat to, e.g. doorbell/heartbeat")
+	flag.DurationVar(&cfg.HeartbeatInterval, "heartbeat-interval", time.Minute, "how often to publish the heartbeat")
+	flag.StringVar(&cfg.ActionField, "action-field", "action", "JSON key holding the button action; a dotted path such as data.action reaches into nested objects")
+	flag.IntVar(&cfg.NotifyConcurrency, "notify-concurrency", 4, "most notifications to deliver at once, dropping any beyond that; 0 for no limit")
+	flag.Var(cfg.SlackBlocks, "slack-blocks", "per-action Slack block kit template file such as single=/etc/doorbell/single.json; repeatable")
+	flag.DurationVar(&cfg.Cooldown, "cooldown", 0, "ignore presses for this long after a chime finishes; 0 disables")
+	flag.Float64Var(&cfg.CooldownMultiplier, "cooldown-multiplier", 2, "grow the cooldown by this factor for each press in a rapid run")
+	flag.DurationVar(&cfg.CooldownMax, "cooldown-max", time.Minute, "longest the cooldown can grow to")
+	flag.DurationVar(&cfg.CooldownReset, "cooldown-reset", time.Minute, "quiet period after which the cooldown drops back to -cooldown")
+	flag.StringVar(&cfg.StartupSound, "startup-sound", "", "sound to play once doorbell is ready")
+	flag.StringVar(&cfg.ShutdownSound, "shutdown-sound", "", "sound to play on SIGINT or SIGTERM before exiting")
+	flag.DurationVar(&cfg.PlayGap, "play-gap", 0, "silence to keep after each chime before another can start")
+	flag.StringVar(&cfg.Proxy, "proxy", "", "HTTP proxy URL for notifications; defaults to $HTTPS_PROXY / $HTTP_PROXY")
+	flag.Var(cfg.NotifyDelays, "notify-delay", "per-action wait before notifying such as single=10s, cancelled by an ack; repeatable")
+	flag.DurationVar(&cfg.MaxSoundDuration, "max-sound-duration", 30*time.Second, "cut any sound off after this long; 0 for no limit")
+	flag.StringVar(&cfg.RapidSound, "rapid-sound", "", "sound for a press that quickly repeats the last one")
+	flag.StringVar(&cfg.ComboSound, "combo-sound", "", "sound for a press that quickly follows a different one, e.g. single then double")
+	flag.DurationVar(&cfg.PressWindow, "press-window", 5*time.Second, "how close presses have to be to count as rapid or combo")
+	flag.StringVar(&cfg.ModeTopic, "mode-topic", "", "MQTT topic to keep the current mode on as a retained message, e.g. doorbell/mode")
+	doctorPtr := flag.Bool("doctor", false, "check sounds, audio output, the broker and notifiers, then exit")
+	flag.IntVar(&cfg.BatteryThreshold, "battery-threshold", 0, "send a one-off alert when a button's battery drops below this percentage; 0 disables")
+	flag.IntVar(&cfg.BatteryHysteresis, "battery-hysteresis", 5, "how many percent above -battery-threshold the battery must recover to before it can alert again")
+	flag.IntVar(&cfg.LinkThreshold, "linkquality-threshold", 0, "send a one-off alert when a button's link quality drops below this; 0 disables")
+	flag.IntVar(&cfg.LinkHysteresis, "linkquality-hysteresis", 10, "how far above -linkquality-threshold link quality must recover to before it can alert again")
+	flag.DurationVar(&cfg.ReconnectInterval, "reconnect-interval", 30*time.Second, "longest to wait between attempts to reconnect to the broker")
+	configPtr := flag.String("config", "", "JSON file with broker, credentials, client ID, topics and sounds; flags and environment variables override it")
+	flag.StringVar(&cfg.ClientID, "client-id", "", "MQTT client ID (defaults to go_mqtt_client-<hostname>)")
+	flag.Var(&cfg.SoundMap, "sound", "[topic:]action=path to play path for matching presses; topic takes MQTT wildcards, action globs; repeatable, first match wins")
+	flag.Var(&cfg.JSONWebhooks, "json-webhook", "URL to POST each event to as JSON; repeatable")
+	flag.StringVar(&cfg.TelegramToken, "telegram-token", "", fmt.Sprintf("Telegram bot token (defaults to $%s)", TELEGRAM_TOKEN_ENV_VAR))
+	flag.StringVar(&cfg.TelegramChat, "telegram-chat", "", "Telegram chat ID for the bot to message")
+	flag.DurationVar(&cfg.TelegramTimeout, "telegram-timeout", 0, "delivery timeout for Telegram, overriding -notify-timeout")
+	flag.StringVar(&cfg.PushoverToken, "pushover-token", "", fmt.Sprintf("Pushover application token (defaults to $%s)", PUSHOVER_TOKEN_ENV_VAR))
+	flag.StringVar(&cfg.PushoverUser, "pushover-user", "", "Pushover user or group key to push to")
+	flag.DurationVar(&cfg.PushoverTimeout, "pushover-timeout", 0, "delivery timeout for Pushover, overriding -notify-timeout")
+	flag.StringVar(&cfg.NtfyURL, "ntfy", "", "ntfy topic URL to publish to, e.g. https://ntfy.sh/my-doorbell")
+	flag.StringVar(&cfg.NtfyToken, "ntfy-token", "", fmt.Sprintf("ntfy access token (defaults to $%s)", NTFY_TOKEN_ENV_VAR))
+	flag.DurationVar(&cfg.NtfyTimeout, "ntfy-timeout", 0, "delivery timeout for ntfy, overriding -notify-timeout")
+	flag.Var(&cfg.NotifyFor, "notify-for", "notifier=event,... to send that kind of notifier (slack, matrix, discord, webhook, json-webhook, telegram, pushover, ntfy) only these actions or press classes, e.g. pushover=single,battery; repeatable")
+	flag.StringVar(&cfg.DNDTopic, "dnd-topic", "", "MQTT topic taking on or off to switch do not disturb, which silences the chime but still notifies")
+	flag.StringVar(&cfg.History, "history", os.Getenv(HISTORY_ENV_VAR), fmt.Sprintf("file to record every press in, as JSON lines, for \"doorbell history\" and /history (defaults to $%s)", HISTORY_ENV_VAR))
+	flag.Int64Var(&cfg.HistoryMaxSize, "history-max-size", 4<<20, "move the history file to .1 once it reaches this many bytes, replacing the one before; 0 keeps everything")
+	flag.StringVar(&cfg.VolumeTopic, "volume-topic", "", "MQTT topic taking a number of decibels to turn every sound up or down by at runtime, e.g. -10; 0 restores it")
+	flag.StringVar(&cfg.Busy, "busy", busy_drop, "what to do with a press while the chime is playing: drop, queue or interrupt")
+	flag.DurationVar(&cfg.Debounce, "debounce", 0, "ignore a repeat of the same action on the same topic within this long of the last one acted on")
+	flag.StringVar(&cfg.Announce, "announce", "", "text to speak after the chime, a template over the message such as \"someone is at {{.Topic}}\"")
+	flag.BoolVar(&cfg.AnnounceOnly, "announce-only", false, "speak the -announce text instead of playing the chime")
+	flag.StringVar(&cfg.TTSCommand, "tts-command", "espeak-ng --stdin --stdout", "text to speech command reading text on stdin and writing WAV to stdout, e.g. piper --model voice.onnx --output_file -")
+	flag.BoolVar(&cfg.HADiscovery, "ha-discovery", false, "publish Home Assistant MQTT discovery for a press event, a battery sensor and a do not disturb switch")
+	flag.StringVar(&cfg.HAPrefix, "ha-prefix", "homeassistant", "Home Assistant discovery prefix")
+	flag.StringVar(&cfg.HANode, "ha-node", "doorbell", "node ID for Home Assistant, and the root of the topics its entities use")
+	flag.Var(&cfg.Snapshots, "snapshot", "[topic=]URL of a camera still (http, https, or rtsp through ffmpeg) to attach to notifications for presses on topic, or all topics; repeatable")
+	flag.DurationVar(&cfg.SnapshotTimeout, "snapshot-timeout", 5*time.Second, "longest to wait for a camera snapshot before notifying without one")
+	flag.Var(&cfg.Outputs, "output", "where presses are sounded: local for this machine's speaker, mqtt to republish on -ring-topic; repeatable (defaults to local)")
+	flag.StringVar(&cfg.RingTopic, "ring-topic", "", "MQTT topic the mqtt output republishes presses on; satellite doorbells in other rooms listen with -topic")
+	flag.Var(&cfg.Hooks, "hook", "run alongside the chime for an action or press class (* for every press): action[@timeout]=exec:command with the press in DOORBELL_* variables, action=mqtt:topic[=payload] or action=http:url to POST the event as JSON; repeatable")
+	flag.DurationVar(&cfg.HookTimeout, "hook-timeout", 10*time.Second, "how long a hook may take, unless it gives its own timeout")
+	flag.BoolVar(&cfg.Simulate, "simulate", false, "don't connect to the broker; read presses from stdin instead, one per line as [topic] action or [topic] {json}")
+	flag.DurationVar(&cfg.SimulateEvery, "simulate-every", 0, "with -simulate, also press -simulate-action this often")
+	flag.StringVar(&cfg.SimulateAction, "simulate-action", "single", "action pressed by -simulate-every")
+	flag.BoolVar(&cfg.NoAudio, "no-audio", false, "don't open the speaker; sounds take as long as usual but play nowhere")
+	flag.StringVar(&cfg.SoundCache, "sound-cache", default_sound_cache(), "directory that sounds given as http(s) URLs are downloaded to")
+	flag.IntVar(&cfg.QoS, "qos", 1, "MQTT QoS to subscribe with, and for the availability messages: 0, 1 or 2")
+	flag.BoolVar(&cfg.CleanSession, "clean-session", true, "start a clean MQTT session on each connect; false keeps a persistent session so the broker holds presses while we're away (needs a stable -client-id)")
+	flag.StringVar(&cfg.AvailabilityTopic, "availability-topic", "", "retained topic that says online while doorbell is connected, and offline (as the broker's Last Will) once it isn't")
+	flag.Var(&cfg.Presence, "presence", "MQTT topic with someone's presence, e.g. a Home Assistant device tracker (home/not_home) or a zigbee2mqtt presence sensor; repeatable")
+	flag.Var(&cfg.PresencePing, "presence-ping", "host or IP, such as a phone, that counts as someone home while it answers ping; repeatable")
+	flag.DurationVar(&cfg.PresenceInterval, "presence-interval", time.Minute, "how often to ping -presence-ping hosts")
+	flag.DurationVar(&cfg.PresenceTimeout, "presence-timeout", 10*time.Minute, "how long a -presence-ping host can go unanswered before it counts as away")
+	flag.Var(&cfg.NotifyWhen, "notify-when", "notifier=home|away|always to send that kind of notifier (as for -notify-for) only while someone is home or nobody is, e.g. pushover=away; repeatable")
+	flag.Parse()
+
+	facility := ""
+	if *syslogPtr {
+		facility = *facilityPtr
+	}
+	if err := setup_logging(*levelPtr, *formatPtr, facility, *tagPtr); err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	// kept as the flags left it, for SIGHUP to resolve again
+	flags := cfg
+	cfg, err := resolve_config(flags, *configPtr, set)
+	if err != nil {
+		fmt.Printf("couldn't load config: %v\n", err)
 		os.Exit(1)
 	}
 
-	slackPtr := flag.String("doslack", "", "webhook for Slack messages")
-	flag.Parse()
+	if err := validate_notify_when(cfg.NotifyWhen); err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	if cfg.QoS < 0 || cfg.QoS > 2 {
+		fmt.Printf("-qos should be 0, 1 or 2, not %d\n", cfg.QoS)
+		os.Exit(2)
+	}
+	if cfg.Busy != busy_drop && cfg.Busy != busy_queue && cfg.Busy != busy_interrupt {
+		fmt.Printf("-busy should be drop, queue or interrupt, not %q\n", cfg.Busy)
+		os.Exit(2)
+	}
+
+	no_audio = cfg.NoAudio
+	if cfg.Proxy != "" {
+		http_client.Transport = proxy_transport(cfg.Proxy)
+	}
+
+	if *doctorPtr {
+		os.Exit(doctor(cfg))
+	}
 
 	button := make(chan mqtt.Message)
 	done := make(chan bool)
 
 	listener := make_listener(button)
 
-	client := setup_client(listener)
+	st := new_status()
+	st.set_topics(cfg.Topics)
+	handlers := make(map[string]mqtt.MessageHandler)
+	if cfg.DNDTopic != "" {
+		handlers[cfg.DNDTopic] = func(client mqtt.Client, msg mqtt.Message) {
+			on, err := parse_switch(string(msg.Payload()))
+			if err != nil {
+				slog.Warn("ignoring do not disturb message", "err", err)
+				return
+			}
+			st.set_dnd(on)
+		}
+	}
+	if cfg.VolumeTopic != "" {
+		handlers[cfg.VolumeTopic] = func(client mqtt.Client, msg mqtt.Message) {
+			db, err := strconv.ParseFloat(strings.TrimSpace(string(msg.Payload())), 64)
+			if err != nil {
+				slog.Warn("ignoring volume message: want a number of decibels", "payload", string(msg.Payload()))
+				return
+			}
+			st.set_volume(db)
+		}
+	}
 
-	go receiver(button, done, *slackPtr)
+	for _, topic := range cfg.Presence {
+		handlers[topic] = st.presence.handler(topic)
+	}
+	stop_pinging := make(chan struct{})
+	pinged := make(chan bool, 1)
+	if len(cfg.PresencePing) > 0 {
+		go st.presence.ping(cfg.PresencePing, cfg.PresenceInterval, cfg.PresenceTimeout, stop_pinging, pinged)
+	} else {
+		pinged <- true
+	}
 
-	defer client.Disconnect(250)
-	select {}
+	var ha *homeAssistant
+	if cfg.HADiscovery {
+		ha = &homeAssistant{Prefix: cfg.HAPrefix, Node: cfg.HANode, Availability: cfg.AvailabilityTopic}
+		handlers[ha.command_topic()] = func(client mqtt.Client, msg mqtt.Message) {
+			on, err := parse_switch(string(msg.Payload()))
+			if err != nil {
+				slog.Warn("ignoring Home Assistant switch message", "err", err)
+				return
+			}
+			st.set_dnd(on)
+		}
+	}
+
+	var client mqtt.Client
+	if cfg.Simulate {
+		// never connected, so anything published is dropped with a warning
+		slog.Info("simulating: not connecting to the broker")
+		client = mqtt.NewClient(client_options(listener, handlers, st, cfg))
+	} else {
+		client = setup_client(listener, handlers, st, cfg)
+	}
+
+	if ha != nil {
+		ha.client = client
+		ha.discover(event_types(cfg))
+		ha.dnd(st.dnd())
+		st.watch_dnd(ha.dnd)
+	}
+
+	acks := make(chan bool)
+	var server *http.Server
+	if cfg.HTTPAddr != "" {
+		server = serve_http(cfg.HTTPAddr, client, listener, acks, st, cfg)
+	}
+
+	outputs, err := make_outputs(cfg, client)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	loaded, err := load_settings(cfg, client)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	reloads := make(chan settings)
+	go receiver(button, acks, reloads, done, st, ha, outputs, loaded)
+	go watch_reloads(client, flags, *configPtr, set, st, reloads)
+	stop_simulating := make(chan struct{})
+	simulated := make(chan bool, 1)
+	if cfg.Simulate {
+		go simulate(client, listener, os.Stdin, cfg, st, stop_simulating, simulated)
+	} else {
+		simulated <- true
+	}
+
+	if cfg.ModeTopic != "" {
+		go publish_mode(client, cfg.ModeTopic, cfg.Policies, st)
+	}
+
+	if cfg.HeartbeatTopic != "" && cfg.HeartbeatInterval > 0 {
+		go heartbeat(client, cfg.HeartbeatTopic, cfg.HeartbeatInterval, st)
+	}
+
+	// on SIGINT or SIGTERM stop listening, then closing the button channel
+	// lets receiver play the shutdown sound before it reports it's finished
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	slog.Info("shutting down", "signal", sig.String())
+	// a second signal means don't wait for the shutdown sound or notifications
+	go func() {
+		sig := <-signals
+		slog.Warn("signalled again, exiting now", "signal", sig.String())
+		os.Exit(1)
+	}()
+	// nothing may feed the button channel once it's closed
+	if server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdown_grace)
+		server.Shutdown(ctx)
+		cancel()
+	}
+	// a clean disconnect doesn't set off the Last Will
+	if cfg.AvailabilityTopic != "" && client.IsConnected() {
+		publish_availability(client, cfg, "offline")
+	}
+	client.Disconnect(250)
+	close(stop_simulating)
+	<-simulated
+	close(stop_pinging)
+	<-pinged
+	close(button)
+	<-done
+	slog.Info("shut down cleanly")
 }
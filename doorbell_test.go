@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// initialise and play sounds without touching the speaker. set once, before
+// anything runs, since receiver's playbacks read it from their own goroutines
+func TestMain(m *testing.M) {
+	no_audio = true
+	os.Exit(m.Run())
+}
+
+func TestDirectoryPlayerPicksEverySound(t *testing.T) {
+	dir := t.TempDir()
+	names := []string{"a.wav", "b.wav", "c.wav"}
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(dir, name), make_wav(wav_format_pcm, 16, 1, false, wav_samples), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not a sound"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &player{Path: dir}
+	if err := p.init(); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	defer p.close()
+	if len(p.choices) != len(names) {
+		t.Fatalf("got %d choices, want %d", len(p.choices), len(names))
+	}
+	for _, choice := range p.choices {
+		if len(choice.choices) != 0 {
+			t.Errorf("%s has choices of its own: %d", choice.Path, len(choice.choices))
+		}
+	}
+
+	picked := make(map[string]int)
+	for i := 0; i < 300; i++ {
+		picked[filepath.Base(p.pick().Path)]++
+	}
+	for _, name := range names {
+		if picked[name] == 0 {
+			t.Errorf("%s was never picked in 300 tries: %v", name, picked)
+		}
+	}
+}
+
+func TestDirectoryPlayerNeedsASound(t *testing.T) {
+	p := &player{Path: t.TempDir()}
+	if err := p.init(); err == nil {
+		t.Error("empty directory loaded without an error")
+	}
+}
+
+// a press fed in through make_listener plays, notifies and is counted, and
+// a status report without an action only updates the device
+func TestReceiver(t *testing.T) {
+	dir := t.TempDir()
+	sound := filepath.Join(dir, "ding.wav")
+	if err := os.WriteFile(sound, make_wav(wav_format_pcm, 16, 1, false, wav_samples), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	delivered := make(chan Event, 10)
+	fake_transport(t, func(r *http.Request) (*http.Response, error) {
+		var ev Event
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			t.Errorf("webhook body: %v", err)
+		}
+		delivered <- ev
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("")), Header: http.Header{}}, nil
+	})
+	cfg := config{
+		Topics:        stringList{"zigbee2mqtt/doorbell"},
+		ActionField:   "action",
+		SingleSound:   sound,
+		DoubleSound:   sound,
+		JSONWebhooks:  stringList{"http://hooks.example/doorbell"},
+		NotifyTimeout: time.Second,
+		PressWindow:   time.Second,
+	}
+	st := new_status()
+	st.set_topics(cfg.Topics)
+	loaded, err := load_settings(cfg, nil)
+	if err != nil {
+		t.Fatalf("load_settings: %v", err)
+	}
+	button := make(chan mqtt.Message)
+	finished := make(chan bool)
+	go receiver(button, make(chan bool), make(chan settings), finished, st, nil, []output{localOutput{}}, loaded)
+
+	listener := make_listener(button)
+	listener(nil, new_message("zigbee2mqtt/doorbell", []byte(`{"battery":64,"linkquality":18}`), false, 0))
+	listener(nil, new_message("zigbee2mqtt/doorbell", []byte(`{"action":"double","battery":63}`), false, 0))
+	select {
+	case ev := <-delivered:
+		if ev.Topic != "zigbee2mqtt/doorbell" || ev.Action != "double" || ev.Battery != 63 {
+			t.Errorf("notified %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification for the press")
+	}
+	close(button)
+	<-finished
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.presses["double"] != 1 || len(st.presses) != 1 {
+		t.Errorf("counted presses %v, want one double", st.presses)
+	}
+	if d := st.devices["zigbee2mqtt/doorbell"]; d == nil || d.Battery != 63 || d.Linkquality != 18 {
+		t.Errorf("device state %+v", d)
+	}
+	select {
+	case ev := <-delivered:
+		t.Errorf("extra notification %+v", ev)
+	default:
+	}
+}
+
+// shutting down waits out the chime rather than leaving it to call back
+// into a receiver that's gone
+func TestReceiverWaitsForPlaybacks(t *testing.T) {
+	sound := filepath.Join(t.TempDir(), "ding.wav")
+	// a tenth of a second at 44.1kHz
+	if err := os.WriteFile(sound, make_wav(wav_format_pcm, 16, 1, false, make([]float64, 4410)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := config{
+		Topics:      stringList{"zigbee2mqtt/doorbell"},
+		ActionField: "action",
+		SingleSound: sound,
+		DoubleSound: sound,
+	}
+	loaded, err := load_settings(cfg, nil)
+	if err != nil {
+		t.Fatalf("load_settings: %v", err)
+	}
+	button := make(chan mqtt.Message)
+	finished := make(chan bool)
+	go receiver(button, make(chan bool), make(chan settings), finished, new_status(), nil, []output{localOutput{}}, loaded)
+
+	pressed := time.Now()
+	button <- new_message("zigbee2mqtt/doorbell", action_payload("action", "single"), false, 0)
+	close(button)
+	<-finished
+	if waited := time.Since(pressed); waited < 100*time.Millisecond {
+		t.Errorf("finished %v after the press, before the chime was over", waited)
+	}
+}
+
+// shutting down sends what -notify-delay is holding back and waits for the
+// hooks still running, rather than dropping them
+func TestShutdownFinishesWork(t *testing.T) {
+	sound := filepath.Join(t.TempDir(), "ding.wav")
+	if err := os.WriteFile(sound, make_wav(wav_format_pcm, 16, 1, false, wav_samples), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var done []string
+	fake_transport(t, func(r *http.Request) (*http.Response, error) {
+		if r.URL.Host == "hook.example" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		mu.Lock()
+		done = append(done, r.URL.Host)
+		mu.Unlock()
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("")), Header: http.Header{}}, nil
+	})
+	cfg := config{
+		Topics:        stringList{"zigbee2mqtt/doorbell"},
+		ActionField:   "action",
+		SingleSound:   sound,
+		DoubleSound:   sound,
+		JSONWebhooks:  stringList{"http://notify.example/doorbell"},
+		NotifyDelays:  durationMap{"single": time.Minute},
+		NotifyTimeout: time.Second,
+		Hooks:         hookList{{Action: "*", Kind: hook_http, Target: "http://hook.example/press"}},
+		HookTimeout:   time.Second,
+	}
+	loaded, err := load_settings(cfg, nil)
+	if err != nil {
+		t.Fatalf("load_settings: %v", err)
+	}
+	button := make(chan mqtt.Message)
+	finished := make(chan bool)
+	go receiver(button, make(chan bool), make(chan settings), finished, new_status(), nil, []output{localOutput{}}, loaded)
+
+	button <- new_message("zigbee2mqtt/doorbell", action_payload("action", "single"), false, 0)
+	close(button)
+	<-finished
+	mu.Lock()
+	defer mu.Unlock()
+	sort.Strings(done)
+	if strings.Join(done, " ") != "hook.example notify.example" {
+		t.Errorf("finished %v before exiting, want the hook and the delayed notification", done)
+	}
+}
+
+func TestBrokerURL(t *testing.T) {
+	cases := []struct {
+		broker string
+		port   int
+		tls    bool
+		want   string
+		secure bool
+	}{
+		{"192.168.0.100", 0, false, "tcp://192.168.0.100:1883", false},
+		{"broker.lan", 1884, false, "tcp://broker.lan:1884", false},
+		{"broker.lan", 0, true, "ssl://broker.lan:8883", true},
+		{"broker.lan", 8884, true, "ssl://broker.lan:8884", true},
+		{"fd00::1", 0, false, "tcp://[fd00::1]:1883", false},
+		{"mqtt://broker.lan", 0, false, "tcp://broker.lan:1883", false},
+		{"tcp://broker.lan:1999", 1884, false, "tcp://broker.lan:1999", false},
+		{"tls://broker.lan", 0, false, "ssl://broker.lan:8883", true},
+		{"ssl://broker.lan", 0, false, "ssl://broker.lan:8883", true},
+		{"mqtts://broker.lan", 0, false, "ssl://broker.lan:8883", true},
+		{"mqtts://broker.lan", 1884, false, "ssl://broker.lan:1884", true},
+		{"mqtts://broker.lan:9883", 1884, false, "ssl://broker.lan:9883", true},
+		{"tcp://broker.lan", 0, true, "ssl://broker.lan:8883", true},
+	}
+	for _, c := range cases {
+		got, secure, err := broker_url(config{Broker: c.broker, Port: c.port, MQTTTLS: c.tls})
+		if err != nil || got != c.want || secure != c.secure {
+			t.Errorf("%s port %d tls %v: got %s secure %v err %v, want %s secure %v", c.broker, c.port, c.tls, got, secure, err, c.want, c.secure)
+		}
+	}
+	if _, _, err := broker_url(config{Broker: "ws://broker.lan"}); err == nil {
+		t.Error("ws:// accepted")
+	}
+}
+
+// muting drops notifications still waiting out -notify-delay, as an ack does
+func TestMuteCancelsDelayedNotifications(t *testing.T) {
+	sound := filepath.Join(t.TempDir(), "ding.wav")
+	if err := os.WriteFile(sound, make_wav(wav_format_pcm, 16, 1, false, wav_samples), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	delivered := make(chan string, 10)
+	fake_transport(t, func(r *http.Request) (*http.Response, error) {
+		var ev Event
+		json.NewDecoder(r.Body).Decode(&ev)
+		delivered <- ev.Action
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("")), Header: http.Header{}}, nil
+	})
+	cfg := config{
+		Topics:        stringList{"zigbee2mqtt/doorbell"},
+		ActionField:   "action",
+		SingleSound:   sound,
+		DoubleSound:   sound,
+		JSONWebhooks:  stringList{"http://hooks.example/doorbell"},
+		NotifyDelays:  durationMap{"single": 200 * time.Millisecond},
+		NotifyTimeout: time.Second,
+	}
+	st := new_status()
+	loaded, err := load_settings(cfg, nil)
+	if err != nil {
+		t.Fatalf("load_settings: %v", err)
+	}
+	button := make(chan mqtt.Message)
+	finished := make(chan bool)
+	go receiver(button, make(chan bool), make(chan settings), finished, st, nil, []output{localOutput{}}, loaded)
+
+	button <- new_message("zigbee2mqtt/doorbell", action_payload("action", "single"), false, 0)
+	// the receiver has taken the press once it's ready for the next message
+	button <- new_message("zigbee2mqtt/doorbell", []byte(`{"battery":50}`), false, 0)
+	st.mute(time.Minute)
+	select {
+	case action := <-delivered:
+		t.Errorf("notified %s despite the mute", action)
+	case <-time.After(400 * time.Millisecond):
+	}
+
+	// without the mute it goes once the delay is up
+	st.mute(0)
+	button <- new_message("zigbee2mqtt/doorbell", action_payload("action", "single"), false, 0)
+	select {
+	case <-delivered:
+	case <-time.After(2 * time.Second):
+		t.Error("delayed notification never went")
+	}
+	close(button)
+	<-finished
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// split a repeatable action=value flag
+func split_action_value(value string) (string, string, error) {
+	action, v, found := strings.Cut(value, "=")
+	if !found || action == "" {
+		return "", "", fmt.Errorf("%q needs the form action=value", value)
+	}
+	return action, v, nil
+}
+
+// per-action gain in decibels, from repeated -gain single=3 flags
+type gainMap map[string]float64
+
+func (g gainMap) String() string {
+	var parts []string
+	for action, db := range g {
+		parts = append(parts, fmt.Sprintf("%s=%g", action, db))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+func (g gainMap) Set(value string) error {
+	action, v, err := split_action_value(value)
+	if err != nil {
+		return err
+	}
+	db, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return fmt.Errorf("bad gain %q for %s: %v", v, action, err)
+	}
+	g[action] = db
+	return nil
+}
+
+// per-action strings, from repeated -flag single=value
+type actionMap map[string]string
+
+func (m actionMap) String() string {
+	var parts []string
+	for action, v := range m {
+		parts = append(parts, action+"="+v)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+func (m actionMap) Set(value string) error {
+	action, v, err := split_action_value(value)
+	if err != nil {
+		return err
+	}
+	m[action] = v
+	return nil
+}
+
+// per-action durations, from repeated -flag single=10s
+type durationMap map[string]time.Duration
+
+func (m durationMap) String() string {
+	var parts []string
+	for action, d := range m {
+		parts = append(parts, fmt.Sprintf("%s=%v", action, d))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+func (m durationMap) Set(value string) error {
+	action, v, err := split_action_value(value)
+	if err != nil {
+		return err
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return fmt.Errorf("bad duration %q for %s: %v", v, action, err)
+	}
+	m[action] = d
+	return nil
+}
+
+// every value of a repeatable flag, in order
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// an environment variable, or fallback when it isn't set
+func env_or(name string, fallback string) string {
+	if v, ok := os.LookupEnv(name); ok {
+		return v
+	}
+	return fallback
+}
+
+// a numeric environment variable, or fallback when it isn't set
+func env_int(name string, fallback int) int {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return fallback
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		fatal("environment variable should be a number", "name", name, "value", v)
+	}
+	return n
+}
+
+// a decimal environment variable, or fallback when it isn't set
+func env_float(name string, fallback float64) float64 {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		fatal("environment variable should be a number", "name", name, "value", v)
+	}
+	return f
+}
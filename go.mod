@@ -1,6 +1,6 @@
 module psaffrey/doorbell
 
-go 1.18
+go 1.21
 
 require (
 	github.com/eclipse/paho.mqtt.golang v1.4.1
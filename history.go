@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// every press, one JSON object per line. there's no SQLite driver among
+// our dependencies, and an append-only log needs nothing more than the
+// standard library and stays easy to grep
+type history struct {
+	Path string
+	// once the file would grow past this many bytes it's moved to Path.1,
+	// so the history kept is between one and two files' worth
+	MaxSize int64
+}
+
+type historyEntry struct {
+	Time        time.Time `json:"time"`
+	Topic       string    `json:"topic"`
+	Action      string    `json:"action"`
+	Battery     uint16    `json:"battery,omitempty"`
+	Linkquality uint16    `json:"linkquality,omitempty"`
+}
+
+// add a press to the file. does nothing when no path is configured
+func (h *history) record(e historyEntry) {
+	if h == nil || h.Path == "" {
+		return
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		slog.Warn("couldn't encode history", "err", err)
+		return
+	}
+	line = append(line, '\n')
+	if err := rotate_file(h.Path, h.MaxSize, int64(len(line))); err != nil {
+		slog.Warn("couldn't rotate history file", "path", h.Path, "err", err)
+	}
+	f, err := os.OpenFile(h.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		slog.Warn("couldn't open history file", "path", h.Path, "err", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(line); err != nil {
+		slog.Warn("couldn't write history", "path", h.Path, "err", err)
+	}
+}
+
+// presses at or after since, oldest first, from the rotated file and then
+// the current one. lines that don't parse, such as one cut short by a
+// crash, are skipped
+func read_history(path string, since time.Time) ([]historyEntry, error) {
+	older, err := read_history_file(path+".1", since)
+	rotated := err == nil
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	entries, err := read_history_file(path, since)
+	if err != nil {
+		// caught between moving the file aside and the next press
+		if errors.Is(err, fs.ErrNotExist) && rotated {
+			return older, nil
+		}
+		return nil, err
+	}
+	return append(older, entries...), nil
+}
+
+func read_history_file(path string, since time.Time) ([]historyEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	start := history_offset(f, info.Size(), since)
+	var entries []historyEntry
+	scanner := bufio.NewScanner(io.NewSectionReader(f, start, info.Size()-start))
+	for scanner.Scan() {
+		var e historyEntry
+		if json.Unmarshal(scanner.Bytes(), &e) != nil {
+			continue
+		}
+		if !e.Time.Before(since) {
+			entries = append(entries, e)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// where the first press at or after since starts. presses are appended as
+// they happen, so the file is in time order and can be bisected rather than
+// read from the beginning
+func history_offset(f io.ReaderAt, size int64, since time.Time) int64 {
+	lo, hi := int64(0), size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		if e, _, ok := history_line_from(f, size, mid); ok && e.Time.Before(since) {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	_, start, _ := history_line_from(f, size, lo)
+	return start
+}
+
+// the first entry that parses on a line starting at or after offset, and
+// where that line starts. ok is false when there isn't one
+func history_line_from(f io.ReaderAt, size int64, offset int64) (e historyEntry, start int64, ok bool) {
+	// back up one byte so a line starting exactly at offset is found
+	if offset > 0 {
+		offset--
+	}
+	r := bufio.NewReader(io.NewSectionReader(f, offset, size-offset))
+	pos := offset
+	if offset > 0 {
+		// the rest of the line offset falls in
+		partial, err := r.ReadBytes('\n')
+		pos += int64(len(partial))
+		if err != nil {
+			return e, size, false
+		}
+	}
+	for {
+		line, err := r.ReadBytes('\n')
+		var parsed historyEntry
+		if len(line) > 0 && json.Unmarshal(line, &parsed) == nil {
+			return parsed, pos, true
+		}
+		pos += int64(len(line))
+		if err != nil {
+			return e, size, false
+		}
+	}
+}
+
+// doorbell history [-since 24h] [-history path] [-json]
+func history_command(args []string) int {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	path := fs.String("history", os.Getenv(HISTORY_ENV_VAR), fmt.Sprintf("history file to read (defaults to $%s)", HISTORY_ENV_VAR))
+	since := fs.Duration("since", 24*time.Hour, "how far back to go")
+	as_json := fs.Bool("json", false, "print JSON lines rather than a table")
+	fs.Parse(args)
+	if *path == "" {
+		fmt.Fprintf(os.Stderr, "need -history or $%s\n", HISTORY_ENV_VAR)
+		return 2
+	}
+	entries, err := read_history(*path, time.Now().Add(-*since))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't read history: %v\n", err)
+		return 1
+	}
+	if *as_json {
+		enc := json.NewEncoder(os.Stdout)
+		for _, e := range entries {
+			enc.Encode(e)
+		}
+		return 0
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tTOPIC\tACTION\tBATTERY\tLINK QUALITY")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\n", e.Time.Local().Format("2006-01-02 15:04:05"), e.Topic, e.Action, e.Battery, e.Linkquality)
+	}
+	w.Flush()
+	return 0
+}
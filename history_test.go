@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistoryOffset(t *testing.T) {
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	var file bytes.Buffer
+	var times []time.Time
+	for i := 0; i < 50; i++ {
+		// a press or two per minute, with lines cut short by crashes and
+		// presses that came in within the same second
+		at := base.Add(time.Duration(i/2) * time.Minute)
+		line, _ := json.Marshal(historyEntry{Time: at, Topic: "zigbee2mqtt/doorbell", Action: "single", Battery: uint16(i)})
+		file.Write(append(line, '\n'))
+		times = append(times, at)
+		if i%7 == 3 {
+			file.WriteString(`{"time":"2026-01-01T00:`)
+			file.WriteByte('\n')
+		}
+	}
+	data := file.Bytes()
+	r := bytes.NewReader(data)
+	for _, since := range []time.Time{base.Add(-time.Hour), base, base.Add(90 * time.Second), base.Add(10 * time.Minute), base.Add(24 * time.Minute), base.Add(time.Hour)} {
+		start := history_offset(r, int64(len(data)), since)
+		if start != 0 && data[start-1] != '\n' {
+			t.Errorf("since %v: offset %d isn't the start of a line", since, start)
+		}
+		want := 0
+		for _, at := range times {
+			if !at.Before(since) {
+				want++
+			}
+		}
+		got := 0
+		for _, line := range bytes.Split(data[start:], []byte("\n")) {
+			var e historyEntry
+			if json.Unmarshal(line, &e) == nil {
+				if e.Time.Before(since) {
+					t.Errorf("since %v: read %v", since, e.Time)
+				}
+				got++
+			}
+		}
+		if got != want {
+			t.Errorf("since %v: %d entries from offset %d, want %d", since, got, start, want)
+		}
+	}
+}
+
+func TestHistoryRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	// whole seconds keep every line the same length
+	start := time.Now().UTC().Truncate(time.Second)
+	line, _ := json.Marshal(historyEntry{Time: start, Topic: "zigbee2mqtt/doorbell", Action: "single"})
+	h := &history{Path: path, MaxSize: int64(3 * (len(line) + 1))}
+	for i := 0; i < 7; i++ {
+		h.record(historyEntry{Time: start.Add(time.Duration(i) * time.Second), Topic: "zigbee2mqtt/doorbell", Action: "single"})
+	}
+	for _, p := range []string{path, path + ".1"} {
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > h.MaxSize {
+			t.Errorf("%s is %d bytes, over the %d limit", p, info.Size(), h.MaxSize)
+		}
+	}
+	// the oldest file's worth has gone, the rest reads back in order
+	entries, err := read_history(path, start.Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 {
+		t.Fatalf("got %d entries, want 4", len(entries))
+	}
+	for i, e := range entries {
+		if want := start.Add(time.Duration(i+3) * time.Second); !e.Time.Equal(want) {
+			t.Errorf("entry %d at %v, want %v", i, e.Time, want)
+		}
+	}
+	if entries, _ := read_history(path, start.Add(5*time.Second)); len(entries) != 2 {
+		t.Errorf("got %d entries from the last two seconds, want 2", len(entries))
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Home Assistant MQTT discovery: a device with an event entity for
+// presses, a battery sensor and a switch for do not disturb
+type homeAssistant struct {
+	client mqtt.Client
+	// discovery prefix Home Assistant listens on, normally homeassistant
+	Prefix string
+	// node ID, also the root of our own state and command topics
+	Node string
+	// -availability-topic, so the entities go unavailable when we do
+	Availability string
+}
+
+func (h *homeAssistant) topic(parts ...string) string {
+	return h.Node + "/" + strings.Join(parts, "/")
+}
+
+// publish without holding up the caller, which may be the receiver
+func (h *homeAssistant) publish(topic string, retained bool, payload []byte) {
+	token := h.client.Publish(topic, 1, retained, payload)
+	go func() {
+		if token.Wait() && token.Error() != nil {
+			slog.Warn("couldn't publish to Home Assistant", "topic", topic, "err", token.Error())
+		}
+	}()
+}
+
+// an entity's discovery config, marked unavailable along with us when
+// there's an availability topic
+func (h *homeAssistant) entity(config map[string]interface{}) map[string]interface{} {
+	if h.Availability != "" {
+		config["availability_topic"] = h.Availability
+	}
+	return config
+}
+
+func (h *homeAssistant) publish_json(topic string, retained bool, payload interface{}) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		slog.Warn("couldn't encode for Home Assistant", "topic", topic, "err", err)
+		return
+	}
+	h.publish(topic, retained, data)
+}
+
+// retained config messages, so Home Assistant picks the entities up
+// whenever it starts. actions are the event types presses can report
+func (h *homeAssistant) discover(actions []string) {
+	device := map[string]interface{}{
+		"identifiers": []string{h.Node},
+		"name":        "Doorbell",
+		"sw_version":  version,
+	}
+	h.publish_json(h.Prefix+"/event/"+h.Node+"/press/config", true, h.entity(map[string]interface{}{
+		"name":         "Press",
+		"unique_id":    h.Node + "_press",
+		"device_class": "doorbell",
+		"state_topic":  h.topic("press"),
+		"event_types":  actions,
+		"device":       device,
+	}))
+	h.publish_json(h.Prefix+"/sensor/"+h.Node+"/battery/config", true, h.entity(map[string]interface{}{
+		"name":                "Battery",
+		"unique_id":           h.Node + "_battery",
+		"device_class":        "battery",
+		"unit_of_measurement": "%",
+		"state_topic":         h.topic("battery"),
+		"value_template":      "{{ value_json.battery }}",
+		"device":              device,
+	}))
+	h.publish_json(h.Prefix+"/switch/"+h.Node+"/dnd/config", true, h.entity(map[string]interface{}{
+		"name":          "Do not disturb",
+		"unique_id":     h.Node + "_dnd",
+		"icon":          "mdi:bell-off",
+		"state_topic":   h.topic("dnd"),
+		"command_topic": h.command_topic(),
+		"payload_on":    "ON",
+		"payload_off":   "OFF",
+		"device":        device,
+	}))
+	slog.Info("published Home Assistant discovery", "prefix", h.Prefix)
+}
+
+// where Home Assistant sends ON and OFF for the do not disturb switch
+func (h *homeAssistant) command_topic() string {
+	return h.topic("dnd", "set")
+}
+
+// does nothing when discovery isn't enabled
+func (h *homeAssistant) pressed(action string, topic string) {
+	if h == nil {
+		return
+	}
+	h.publish_json(h.topic("press"), false, map[string]string{"event_type": action, "topic": topic})
+}
+
+func (h *homeAssistant) battery(battery uint16, linkquality uint16) {
+	if h == nil || battery == 0 {
+		return
+	}
+	h.publish_json(h.topic("battery"), true, map[string]uint16{"battery": battery, "linkquality": linkquality})
+}
+
+func (h *homeAssistant) dnd(on bool) {
+	if h == nil {
+		return
+	}
+	state := "OFF"
+	if on {
+		state = "ON"
+	}
+	h.publish(h.topic("dnd"), true, []byte(state))
+}
+
+// the actions presses can report: single and double, and any that -sound
+// names outright rather than by pattern
+func event_types(cfg config) []string {
+	types := []string{"single", "double"}
+	seen := map[string]bool{"single": true, "double": true}
+	for _, r := range cfg.SoundMap {
+		if !strings.ContainsAny(r.Action, "*?[\\") && !seen[r.Action] {
+			seen[r.Action] = true
+			types = append(types, r.Action)
+		}
+	}
+	return types
+}
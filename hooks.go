@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// kinds of hook
+const (
+	hook_exec = "exec"
+	hook_mqtt = "mqtt"
+	hook_http = "http"
+)
+
+// something else to do when the bell rings, such as turning on the porch
+// light or telling the NVR to record
+type hook struct {
+	// the action or press class it's for, or * for every press
+	Action string
+	Kind   string
+	// the shell command, the topic to publish to, or the URL to POST the
+	// event to as JSON
+	Target string
+	// published to Target by mqtt hooks. without one the event goes as JSON
+	Payload string
+	// how long it may take, or -hook-timeout when zero
+	Timeout time.Duration
+}
+
+func (h hook) String() string {
+	action := h.Action
+	if h.Timeout > 0 {
+		action += "@" + h.Timeout.String()
+	}
+	target := h.Target
+	if h.Payload != "" {
+		target += "=" + h.Payload
+	}
+	return fmt.Sprintf("%s=%s:%s", action, h.Kind, target)
+}
+
+func (h hook) wants(ev Event) bool {
+	return h.Action == "*" || h.Action == ev.Action || h.Action == ev.Class
+}
+
+// every -hook given, in order
+type hookList []hook
+
+func (l *hookList) String() string {
+	var parts []string
+	for _, h := range *l {
+		parts = append(parts, h.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+func (l *hookList) Set(value string) error {
+	action, rest, found := strings.Cut(value, "=")
+	kind, target, found_kind := strings.Cut(rest, ":")
+	if !found || !found_kind || action == "" || target == "" {
+		return fmt.Errorf("hook %q needs the form action[@timeout]=exec:command, action=mqtt:topic[=payload] or action=http:url", value)
+	}
+	h := hook{Action: action, Kind: kind, Target: target}
+	if a, timeout, found := strings.Cut(action, "@"); found {
+		d, err := time.ParseDuration(timeout)
+		if err != nil {
+			return fmt.Errorf("bad hook timeout %q: %v", timeout, err)
+		}
+		h.Action, h.Timeout = a, d
+	}
+	switch kind {
+	case hook_exec, hook_http:
+	case hook_mqtt:
+		// topics can't hold an =, so the first one starts the payload
+		h.Target, h.Payload, _ = strings.Cut(target, "=")
+	default:
+		return fmt.Errorf("unrecognised hook kind %q: want exec, mqtt or http", kind)
+	}
+	*l = append(*l, h)
+	return nil
+}
+
+// runs the hooks for each press alongside the chime
+type hookRunner struct {
+	client  mqtt.Client
+	Hooks   hookList
+	Timeout time.Duration
+}
+
+// start every hook that wants ev. none of them are waited for, so a slow
+// one holds up nothing but itself; running is only for shutdown to wait on
+func (r hookRunner) fire(ev Event, running *sync.WaitGroup) {
+	for _, h := range r.Hooks {
+		if h.wants(ev) {
+			running.Add(1)
+			go func(h hook) {
+				defer running.Done()
+				r.run(h, ev)
+			}(h)
+		}
+	}
+}
+
+func (r hookRunner) run(h hook, ev Event) {
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = r.Timeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	started := time.Now()
+	var err error
+	switch h.Kind {
+	case hook_exec:
+		err = run_command(ctx, h.Target, ev)
+	case hook_mqtt:
+		err = r.publish(h, ev, timeout)
+	case hook_http:
+		err = post_event(ctx, h.Target, ev)
+	}
+	if err != nil {
+		slog.Warn("hook failed", "hook", h.String(), "topic", ev.Topic, "action", ev.Action, "err", err)
+		return
+	}
+	slog.Info("hook done", "hook", h.String(), "topic", ev.Topic, "action", ev.Action, "duration", time.Since(started).Round(time.Millisecond))
+}
+
+// the press is passed to the command in DOORBELL_* environment variables.
+// it gets its own process group, so running out of time ends anything it
+// started too rather than leaving it holding the output open
+func run_command(ctx context.Context, command string, ev Event) error {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Env = append(os.Environ(),
+		"DOORBELL_TOPIC="+ev.Topic,
+		"DOORBELL_ACTION="+ev.Action,
+		"DOORBELL_CLASS="+ev.Class,
+		"DOORBELL_BATTERY="+strconv.Itoa(int(ev.Battery)),
+		"DOORBELL_LINKQUALITY="+strconv.Itoa(int(ev.Linkquality)),
+		"DOORBELL_TIME="+ev.Time.Format(time.RFC3339),
+	)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	var err error
+	select {
+	case err = <-exited:
+	case <-ctx.Done():
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-exited
+		return ctx.Err()
+	}
+	if err != nil {
+		if output := bytes.TrimSpace(output.Bytes()); len(output) > 0 {
+			return fmt.Errorf("%v: %s", err, output)
+		}
+		return err
+	}
+	return nil
+}
+
+func (r hookRunner) publish(h hook, ev Event, timeout time.Duration) error {
+	payload := []byte(h.Payload)
+	if h.Payload == "" {
+		var err error
+		if payload, err = json.Marshal(ev); err != nil {
+			return err
+		}
+	}
+	token := r.client.Publish(h.Target, 1, false, payload)
+	if !token.WaitTimeout(timeout) {
+		return fmt.Errorf("publish to %s timed out", h.Target)
+	}
+	return token.Error()
+}
+
+func post_event(ctx context.Context, endpoint string, ev Event) error {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	code, body, err := send_json(ctx, http.MethodPost, endpoint, payload, nil)
+	if err != nil {
+		return err
+	}
+	if code/100 != 2 {
+		return fmt.Errorf("%s returned %d: %s", endpoint, code, body)
+	}
+	return nil
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// serve the HTTP endpoints
+func serve_http(addr string, client mqtt.Client, listener mqtt.MessageHandler, acks chan<- bool, st *status, cfg config) *http.Server {
+	if cfg.HTTPToken == "" {
+		slog.Warn("no -http-token: anyone who can reach the HTTP server can ring, mute and change settings", "addr", addr)
+	}
+	server := &http.Server{Addr: addr, Handler: http_handler(client, listener, acks, st, cfg)}
+	go func() {
+		slog.Info("serving HTTP", "addr", addr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Error("HTTP server stopped", "err", err)
+		}
+	}()
+	return server
+}
+
+// the endpoints. /ack accepts GET so it works as a plain link, and POST so
+// it can be used as a Slack or Telegram interactive callback. with
+// -http-token, anything that rings or changes settings needs the token,
+// and so do snapshots, but not /ack, which goes out in notifications as it is
+func http_handler(client mqtt.Client, listener mqtt.MessageHandler, acks chan<- bool, st *status, cfg config) http.Handler {
+	mux := http.NewServeMux()
+	guarded := func(pattern string, handler http.HandlerFunc) {
+		mux.HandleFunc(pattern, require_token(cfg.HTTPToken, true, handler))
+	}
+	mux.HandleFunc("/ack", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		acks <- true
+		fmt.Fprintln(w, "acknowledged")
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		m := st.metrics()
+		var last_ring interface{}
+		if !m.LastPress.IsZero() {
+			last_ring = m.LastPress
+		}
+		var muted_until interface{}
+		if until := st.muted_until(); !until.IsZero() {
+			muted_until = until
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"connected":             client.IsConnected(),
+			"last_ring":             last_ring,
+			"devices":               st.devices_snapshot(),
+			"dropped_notifications": st.dropped(),
+			"dnd":                   st.dnd(),
+			"muted_until":           muted_until,
+			"volume":                st.volume(),
+			"presence":              st.presence.state(),
+			"presence_sources":      st.presence.sources(),
+		})
+	})
+	// GET reports do not disturb; POST switches it with ?state=on or off
+	guarded("/dnd", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			on, err := parse_switch(r.FormValue("state"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			st.set_dnd(on)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]bool{"dnd": st.dnd()})
+	})
+	// a test press, fed through the same path as one from the broker.
+	// ?action defaults to single and ?topic to the first one currently
+	// subscribed to
+	guarded("/ring", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		action := r.FormValue("action")
+		if action == "" {
+			action = "single"
+		}
+		topic := r.FormValue("topic")
+		if topic == "" {
+			topic = st.default_topic()
+		}
+		if topic == "" {
+			http.Error(w, "no topic subscribed to; give ?topic", http.StatusBadRequest)
+			return
+		}
+		listener(client, new_message(topic, action_payload(cfg.ActionField, action), false, 0))
+		fmt.Fprintf(w, "rang %s on %s\n", action, topic)
+	})
+	// POST silences the chime for ?for (an hour by default); DELETE unmutes
+	guarded("/mute", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			d := time.Hour
+			if v := r.FormValue("for"); v != "" {
+				var err error
+				if d, err = time.ParseDuration(v); err != nil || d <= 0 {
+					http.Error(w, fmt.Sprintf("bad duration %q", v), http.StatusBadRequest)
+					return
+				}
+			}
+			st.mute(d)
+		case http.MethodDelete:
+			st.mute(0)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var until interface{}
+		if u := st.muted_until(); !u.IsZero() {
+			until = u
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"muted_until": until})
+	})
+	// presses from the -history file, the last day's unless ?since says otherwise
+	mux.HandleFunc("/history", func(w http.ResponseWriter, r *http.Request) {
+		if cfg.History == "" {
+			http.Error(w, "no -history file configured", http.StatusNotFound)
+			return
+		}
+		since := 24 * time.Hour
+		if v := r.FormValue("since"); v != "" {
+			var err error
+			if since, err = time.ParseDuration(v); err != nil {
+				http.Error(w, fmt.Sprintf("bad duration %q", v), http.StatusBadRequest)
+				return
+			}
+		}
+		entries, err := read_history(cfg.History, time.Now().Add(-since))
+		if err != nil && !os.IsNotExist(err) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if entries == nil {
+			entries = []historyEntry{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+	})
+	// GET reports the runtime volume adjustment; POST sets it with ?db=-10
+	guarded("/volume", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			db, err := strconv.ParseFloat(r.FormValue("db"), 64)
+			if err != nil {
+				http.Error(w, "db should be a number of decibels", http.StatusBadRequest)
+				return
+			}
+			st.set_volume(db)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]float64{"volume": st.volume()})
+	})
+	// stills taken for recent presses, as linked in notifications. they
+	// show whoever's at the door, so with -http-token even reading them
+	// needs it
+	mux.HandleFunc("/snapshot/", require_token(cfg.HTTPToken, false, func(w http.ResponseWriter, r *http.Request) {
+		snap := st.snapshots.get(strings.TrimPrefix(r.URL.Path, "/snapshot/"))
+		if snap == nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", snap.ContentType)
+		w.Write(snap.Data)
+	}))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if !client.IsConnected() {
+			http.Error(w, "not connected to broker", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		write_metrics(w, st.metrics(), client.IsConnected())
+	})
+	return mux
+}
+
+// only let requests through with the token, as a bearer token or ?token.
+// open_reads lets GET through without it, so only changing anything needs
+// it. no token leaves everything open
+func require_token(token string, open_reads bool, handler http.HandlerFunc) http.HandlerFunc {
+	if token == "" {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if open_reads && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+			handler(w, r)
+			return
+		}
+		given := r.URL.Query().Get("token")
+		if bearer, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found {
+			given = bearer
+		}
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "needs -http-token", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// Prometheus text format, so it can be scraped as well as read by eye
+func write_metrics(w http.ResponseWriter, m metrics, connected bool) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	total := 0
+	for _, n := range m.Presses {
+		total += n
+	}
+	fmt.Fprintln(w, "# TYPE doorbell_presses_total counter")
+	fmt.Fprintf(w, "doorbell_presses_total %d\n", total)
+	fmt.Fprintln(w, "# TYPE doorbell_action_presses_total counter")
+	for _, action := range sorted_keys(m.Presses) {
+		fmt.Fprintf(w, "doorbell_action_presses_total{action=\"%s\"} %d\n", label(action), m.Presses[action])
+	}
+	failures := 0
+	for _, n := range m.NotifyFailures {
+		failures += n
+	}
+	fmt.Fprintln(w, "# TYPE doorbell_notification_failures_total counter")
+	fmt.Fprintf(w, "doorbell_notification_failures_total %d\n", failures)
+	fmt.Fprintln(w, "# TYPE doorbell_notifications_total counter")
+	for _, kind := range sorted_keys(m.NotifySuccesses) {
+		fmt.Fprintf(w, "doorbell_notifications_total{notifier=\"%s\",result=\"success\"} %d\n", label(kind), m.NotifySuccesses[kind])
+	}
+	for _, kind := range sorted_keys(m.NotifyFailures) {
+		fmt.Fprintf(w, "doorbell_notifications_total{notifier=\"%s\",result=\"failure\"} %d\n", label(kind), m.NotifyFailures[kind])
+	}
+	fmt.Fprintln(w, "# TYPE doorbell_notifications_dropped_total counter")
+	fmt.Fprintf(w, "doorbell_notifications_dropped_total %d\n", m.DroppedNotifications)
+	fmt.Fprintln(w, "# TYPE doorbell_last_press_timestamp_seconds gauge")
+	last := int64(0)
+	if !m.LastPress.IsZero() {
+		last = m.LastPress.Unix()
+	}
+	fmt.Fprintf(w, "doorbell_last_press_timestamp_seconds %d\n", last)
+	fmt.Fprintln(w, "# TYPE doorbell_mqtt_connected gauge")
+	up := 0
+	if connected {
+		up = 1
+	}
+	fmt.Fprintf(w, "doorbell_mqtt_connected %d\n", up)
+	fmt.Fprintln(w, "# TYPE doorbell_mqtt_disconnects_total counter")
+	fmt.Fprintf(w, "doorbell_mqtt_disconnects_total %d\n", m.Disconnects)
+	fmt.Fprintln(w, "# TYPE doorbell_mqtt_reconnects_total counter")
+	fmt.Fprintf(w, "doorbell_mqtt_reconnects_total %d\n", m.Reconnects)
+	topics := make([]string, 0, len(m.Devices))
+	for topic := range m.Devices {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	// a reading of zero means the device hasn't reported one
+	fmt.Fprintln(w, "# TYPE doorbell_battery_percent gauge")
+	for _, topic := range topics {
+		if d := m.Devices[topic]; d.Battery != 0 {
+			fmt.Fprintf(w, "doorbell_battery_percent{topic=\"%s\"} %d\n", label(topic), d.Battery)
+		}
+	}
+	fmt.Fprintln(w, "# TYPE doorbell_linkquality gauge")
+	for _, topic := range topics {
+		if d := m.Devices[topic]; d.Linkquality != 0 {
+			fmt.Fprintf(w, "doorbell_linkquality{topic=\"%s\"} %d\n", label(topic), d.Linkquality)
+		}
+	}
+	fmt.Fprintln(w, "# TYPE doorbell_last_seen_timestamp_seconds gauge")
+	for _, topic := range topics {
+		fmt.Fprintf(w, "doorbell_last_seen_timestamp_seconds{topic=\"%s\"} %d\n", label(topic), m.Devices[topic].LastSeen.Unix())
+	}
+}
+
+// Prometheus label values escape only backslash, double quote and newline;
+// Go's %q would also escape non-ASCII, which the exposition format reads
+// literally
+var label_escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func label(value string) string {
+	return label_escaper.Replace(value)
+}
+
+func sorted_keys(counts map[string]int) []string {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	seen := time.Unix(1760000000, 0)
+	m := metrics{
+		Presses:         map[string]int{"single": 3, `odd"one\` + "\n": 1, "türklingel": 2},
+		LastPress:       seen,
+		NotifySuccesses: map[string]int{"ntfy": 4},
+		NotifyFailures:  map[string]int{"ntfy": 1},
+		Disconnects:     2,
+		Devices: map[string]deviceState{
+			"zigbee2mqtt/Haustür": {Battery: 87, Linkquality: 120, LastSeen: seen},
+			"zigbee2mqtt/back":    {LastSeen: seen},
+		},
+	}
+	rec := httptest.NewRecorder()
+	write_metrics(rec, m, true)
+	got := rec.Body.String()
+	for _, want := range []string{
+		"doorbell_presses_total 6\n",
+		`doorbell_action_presses_total{action="single"} 3` + "\n",
+		`doorbell_action_presses_total{action="türklingel"} 2` + "\n",
+		`doorbell_action_presses_total{action="odd\"one\\\n"} 1` + "\n",
+		`doorbell_notifications_total{notifier="ntfy",result="success"} 4` + "\n",
+		`doorbell_notifications_total{notifier="ntfy",result="failure"} 1` + "\n",
+		"doorbell_notification_failures_total 1\n",
+		"doorbell_last_press_timestamp_seconds 1760000000\n",
+		"doorbell_mqtt_connected 1\n",
+		"doorbell_mqtt_disconnects_total 2\n",
+		`doorbell_battery_percent{topic="zigbee2mqtt/Haustür"} 87` + "\n",
+		`doorbell_linkquality{topic="zigbee2mqtt/Haustür"} 120` + "\n",
+		`doorbell_last_seen_timestamp_seconds{topic="zigbee2mqtt/back"} 1760000000` + "\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q", want)
+		}
+	}
+	// no reading means no sample rather than a zero
+	if strings.Contains(got, `doorbell_battery_percent{topic="zigbee2mqtt/back"}`) {
+		t.Error("battery reported for a device that hasn't sent one")
+	}
+	if strings.Contains(got, `\u`) || strings.Contains(got, `\x`) {
+		t.Errorf("Go escapes in the output:\n%s", got)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type %q", ct)
+	}
+}
+
+func TestLabel(t *testing.T) {
+	for value, want := range map[string]string{
+		"plain":      "plain",
+		"Haustür 🔔":  "Haustür 🔔",
+		`say "hi"`:   `say \"hi\"`,
+		`back\slash`: `back\\slash`,
+		"two\nlines": `two\nlines`,
+		"tab\tstays": "tab\tstays",
+	} {
+		if got := label(value); got != want {
+			t.Errorf("label(%q) = %q, want %q", value, got, want)
+		}
+	}
+}
+
+func TestRingUsesLiveTopics(t *testing.T) {
+	st := new_status()
+	st.set_topics([]string{"zigbee2mqtt/front"})
+	var rang []string
+	listener := func(client mqtt.Client, msg mqtt.Message) {
+		rang = append(rang, msg.Topic()+" "+string(msg.Payload()))
+	}
+	handler := http_handler(nil, listener, nil, st, config{Topics: stringList{"zigbee2mqtt/front"}, ActionField: "action"})
+	ring := func(target string) int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, target, nil))
+		return rec.Code
+	}
+
+	ring("/ring")
+	// a reload swaps the topics
+	st.set_topics([]string{"zigbee2mqtt/back", "zigbee2mqtt/side"})
+	ring("/ring?action=double")
+	ring("/ring?topic=porch/button")
+	want := []string{
+		`zigbee2mqtt/front {"action":"single"}`,
+		`zigbee2mqtt/back {"action":"double"}`,
+		`porch/button {"action":"single"}`,
+	}
+	if strings.Join(rang, "\n") != strings.Join(want, "\n") {
+		t.Errorf("rang\n%s\nwant\n%s", strings.Join(rang, "\n"), strings.Join(want, "\n"))
+	}
+
+	st.set_topics(nil)
+	if code := ring("/ring"); code != http.StatusBadRequest {
+		t.Errorf("ringing with no topics gave %d", code)
+	}
+}
+
+func TestHTTPToken(t *testing.T) {
+	st := new_status()
+	st.set_topics([]string{"zigbee2mqtt/front"})
+	rings := 0
+	listener := func(client mqtt.Client, msg mqtt.Message) {
+		rings++
+	}
+	acks := make(chan bool, 10)
+	snap, err := st.snapshots.add([]byte{0xff, 0xd8}, "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := http_handler(nil, listener, acks, st, config{ActionField: "action", HTTPToken: "s3cret"})
+	cases := []struct {
+		method, target, authorization string
+		want                          int
+	}{
+		{http.MethodPost, "/ring", "", http.StatusUnauthorized},
+		{http.MethodPost, "/ring?token=wrong", "", http.StatusUnauthorized},
+		{http.MethodPost, "/ring", "Bearer wrong", http.StatusUnauthorized},
+		{http.MethodPost, "/ring?token=s3cret", "", http.StatusOK},
+		{http.MethodPost, "/ring", "Bearer s3cret", http.StatusOK},
+		{http.MethodPost, "/mute?for=1m", "", http.StatusUnauthorized},
+		{http.MethodDelete, "/mute", "Bearer s3cret", http.StatusOK},
+		{http.MethodPost, "/dnd?state=on", "", http.StatusUnauthorized},
+		{http.MethodGet, "/dnd", "", http.StatusOK},
+		{http.MethodPost, "/volume?db=-10", "", http.StatusUnauthorized},
+		{http.MethodGet, "/volume", "", http.StatusOK},
+		// it goes out in notifications as a plain link
+		{http.MethodGet, "/ack", "", http.StatusOK},
+		// but a snapshot shows who's at the door
+		{http.MethodGet, "/snapshot/" + snap.ID, "", http.StatusUnauthorized},
+		{http.MethodGet, "/snapshot/" + snap.ID, "Bearer s3cret", http.StatusOK},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, c.target, nil)
+		if c.authorization != "" {
+			req.Header.Set("Authorization", c.authorization)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != c.want {
+			t.Errorf("%s %s with %q: got %d, want %d", c.method, c.target, c.authorization, rec.Code, c.want)
+		}
+	}
+	if rings != 2 {
+		t.Errorf("rang %d times, want 2", rings)
+	}
+	if st.dnd() || st.volume() != 0 {
+		t.Error("settings changed without the token")
+	}
+}
+
+func TestSnapshotIDs(t *testing.T) {
+	store := &snapshotStore{}
+	seen := make(map[string]bool)
+	var first string
+	for i := 0; i < 50; i++ {
+		snap, err := store.add([]byte{byte(i)}, "image/jpeg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(snap.ID) != 32 || strings.Trim(snap.ID, "0123456789abcdef") != "" {
+			t.Errorf("ID %q isn't 16 bytes of hex", snap.ID)
+		}
+		if seen[snap.ID] {
+			t.Errorf("ID %s handed out twice", snap.ID)
+		}
+		seen[snap.ID] = true
+		if first == "" {
+			first = snap.ID
+		}
+	}
+	// only the newest are kept
+	if len(store.images) != kept_snapshots || store.get(first) != nil {
+		t.Errorf("kept %d snapshots, want the newest %d", len(store.images), kept_snapshots)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"log/syslog"
+	"os"
+	"sync"
+)
+
+// syslog facilities accepted by -syslog-facility
+var syslog_facilities = map[string]syslog.Priority{
+	"kern":   syslog.LOG_KERN,
+	"user":   syslog.LOG_USER,
+	"daemon": syslog.LOG_DAEMON,
+	"local0": syslog.LOG_LOCAL0,
+	"local1": syslog.LOG_LOCAL1,
+	"local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3,
+	"local4": syslog.LOG_LOCAL4,
+	"local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6,
+	"local7": syslog.LOG_LOCAL7,
+}
+
+// log at level and above as text or JSON, to stderr or, when facility is
+// given, syslog. stays on stderr if syslog can't be reached
+func setup_logging(level string, format string, facility string, tag string) error {
+	var threshold slog.Level
+	if err := threshold.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("-log-level should be debug, info, warn or error, not %q", level)
+	}
+	if format != "text" && format != "json" {
+		return fmt.Errorf("-log-format should be text or json, not %q", format)
+	}
+	opts := &slog.HandlerOptions{Level: threshold}
+	var out io.Writer = os.Stderr
+	var syslogged *levelWriter
+	if facility != "" {
+		if writer, err := open_syslog(facility, tag); err != nil {
+			slog.Warn("logging to stderr", "err", err)
+		} else {
+			syslogged = &levelWriter{w: writer}
+			out = syslogged
+			// syslog stamps each line itself
+			opts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+				if len(groups) == 0 && a.Key == slog.TimeKey {
+					return slog.Attr{}
+				}
+				return a
+			}
+		}
+	}
+	var handler slog.Handler
+	if format == "json" {
+		handler = slog.NewJSONHandler(out, opts)
+	} else {
+		handler = slog.NewTextHandler(out, opts)
+	}
+	if syslogged != nil {
+		handler = syslogHandler{Handler: handler, out: syslogged}
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+func open_syslog(facility string, tag string) (*syslog.Writer, error) {
+	priority, ok := syslog_facilities[facility]
+	if !ok {
+		return nil, fmt.Errorf("unrecognised syslog facility %s", facility)
+	}
+	writer, err := syslog.New(priority|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, fmt.Errorf("syslog unavailable: %v", err)
+	}
+	return writer, nil
+}
+
+// hands each record to syslog at the severity of its level
+type syslogHandler struct {
+	slog.Handler
+	out *levelWriter
+}
+
+func (h syslogHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.out.mu.Lock()
+	defer h.out.mu.Unlock()
+	h.out.level = r.Level
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return syslogHandler{Handler: h.Handler.WithAttrs(attrs), out: h.out}
+}
+
+func (h syslogHandler) WithGroup(name string) slog.Handler {
+	return syslogHandler{Handler: h.Handler.WithGroup(name), out: h.out}
+}
+
+type levelWriter struct {
+	mu    sync.Mutex
+	w     *syslog.Writer
+	level slog.Level
+}
+
+func (l *levelWriter) Write(p []byte) (int, error) {
+	var err error
+	switch {
+	case l.level >= slog.LevelError:
+		err = l.w.Err(string(p))
+	case l.level >= slog.LevelWarn:
+		err = l.w.Warning(string(p))
+	case l.level >= slog.LevelInfo:
+		err = l.w.Info(string(p))
+	default:
+		err = l.w.Debug(string(p))
+	}
+	return len(p), err
+}
+
+// log at error level and exit, for what doorbell can't run without
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// an mqtt.Message that didn't come from a broker, for feeding make_listener
+// and receiver directly. /ring and -simulate press through it, and so do
+// the tests
+type syntheticMessage struct {
+	topic    string
+	payload  []byte
+	retained bool
+	qos      byte
+}
+
+var _ mqtt.Message = (*syntheticMessage)(nil)
+
+func new_message(topic string, payload []byte, retained bool, qos byte) *syntheticMessage {
+	return &syntheticMessage{topic: topic, payload: payload, retained: retained, qos: qos}
+}
+
+func (m *syntheticMessage) Duplicate() bool   { return false }
+func (m *syntheticMessage) Qos() byte         { return m.qos }
+func (m *syntheticMessage) Retained() bool    { return m.retained }
+func (m *syntheticMessage) Topic() string     { return m.topic }
+func (m *syntheticMessage) MessageID() uint16 { return 0 }
+func (m *syntheticMessage) Payload() []byte   { return m.payload }
+func (m *syntheticMessage) Ack()              {}
+
+// a button payload pressing action, nested the way a dotted -action-field
+// expects
+func action_payload(field string, action string) []byte {
+	keys := strings.Split(field, ".")
+	var value interface{} = action
+	for i := len(keys) - 1; i >= 0; i-- {
+		value = map[string]interface{}{keys[i]: value}
+	}
+	payload, _ := json.Marshal(value)
+	return payload
+}
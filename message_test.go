@@ -0,0 +1,121 @@
+package main
+
+import (
+	"testing"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestParseButton(t *testing.T) {
+	cases := []struct {
+		name    string
+		field   string
+		payload string
+		want    ButtonMessage
+	}{
+		{
+			name:    "legacy flat",
+			field:   "action",
+			payload: `{"action":"single","battery":91,"linkquality":60,"voltage":2985}`,
+			want:    ButtonMessage{Action: "single", Battery: 91, Linkquality: 60},
+		},
+		{
+			// an Aqara button through zigbee2mqtt 1.x with
+			// include_device_information set
+			name:  "zigbee2mqtt with device information",
+			field: "action",
+			payload: `{"action":"double","battery":100,"device":{"applicationVersion":3,"dateCode":"20161129",` +
+				`"friendlyName":"doorbell","hardwareVersion":30,"ieeeAddr":"0x00158d0001e1a2b3","manufacturerID":4151,` +
+				`"manufacturerName":"LUMI","model":"WXKG11LM","networkAddress":12345,"powerSource":"Battery",` +
+				`"softwareBuildID":"3000-0001","stackVersion":2,"type":"EndDevice","zclVersion":1},` +
+				`"linkquality":87,"power_outage_count":16,"update":{"installed_version":-1,"latest_version":-1,"state":null},` +
+				`"update_available":null,"voltage":3005}`,
+			want: ButtonMessage{Action: "double", Battery: 100, Linkquality: 87, Device: &deviceInfo{}},
+		},
+		{
+			name:    "battery and link quality only under device",
+			field:   "action",
+			payload: `{"action":"single","device":{"friendlyName":"doorbell","battery":40,"linkquality":120}}`,
+			want:    ButtonMessage{Action: "single", Battery: 40, Linkquality: 120, Device: &deviceInfo{Battery: 40, Linkquality: 120}},
+		},
+		{
+			name:    "top level wins over device",
+			field:   "action",
+			payload: `{"action":"single","battery":80,"device":{"battery":40,"linkquality":120}}`,
+			want:    ButtonMessage{Action: "single", Battery: 80, Linkquality: 120, Device: &deviceInfo{Battery: 40, Linkquality: 120}},
+		},
+		{
+			name:    "other key",
+			field:   "click",
+			payload: `{"click":"long","battery":55}`,
+			want:    ButtonMessage{Action: "long", Battery: 55},
+		},
+		{
+			name:    "action in a nested object",
+			field:   "data.action",
+			payload: `{"data":{"action":"single","source":"button"},"battery":70,"linkquality":33}`,
+			want:    ButtonMessage{Action: "single", Battery: 70, Linkquality: 33},
+		},
+		{
+			name:    "nested path missing",
+			field:   "data.action",
+			payload: `{"data":"single","battery":70}`,
+			want:    ButtonMessage{Battery: 70},
+		},
+		{
+			name:    "numeric action",
+			field:   "button",
+			payload: `{"button":2}`,
+			want:    ButtonMessage{Action: "2"},
+		},
+		{
+			name:    "status report without a press",
+			field:   "action",
+			payload: `{"battery":64,"linkquality":18}`,
+			want:    ButtonMessage{Battery: 64, Linkquality: 18},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := parse_button([]byte(c.payload), c.field)
+			if err != nil {
+				t.Fatalf("parse_button: %v", err)
+			}
+			if got.Action != c.want.Action || got.Battery != c.want.Battery || got.Linkquality != c.want.Linkquality {
+				t.Errorf("got action %q battery %d linkquality %d, want %q %d %d",
+					got.Action, got.Battery, got.Linkquality, c.want.Action, c.want.Battery, c.want.Linkquality)
+			}
+			if (got.Device == nil) != (c.want.Device == nil) || (got.Device != nil && *got.Device != *c.want.Device) {
+				t.Errorf("got device %+v, want %+v", got.Device, c.want.Device)
+			}
+		})
+	}
+}
+
+func TestParseButtonRejectsBadJSON(t *testing.T) {
+	for _, field := range []string{"action", "data.action"} {
+		if _, err := parse_button([]byte(`{"action":`), field); err == nil {
+			t.Errorf("%s: truncated JSON parsed without an error", field)
+		}
+	}
+}
+
+// what /ring and -simulate publish comes back out as the same action
+func TestActionPayloadRoundTrips(t *testing.T) {
+	for _, field := range []string{"action", "click", "data.action", "a.b.c"} {
+		got, err := parse_button(action_payload(field, "double"), field)
+		if err != nil || got.Action != "double" {
+			t.Errorf("%s: got %q, %v from %s", field, got.Action, err, action_payload(field, "double"))
+		}
+	}
+}
+
+func TestMakeListener(t *testing.T) {
+	button := make(chan mqtt.Message, 1)
+	listener := make_listener(button)
+	listener(nil, new_message("zigbee2mqtt/doorbell", []byte(`{"action":"single"}`), true, 1))
+	msg := <-button
+	if msg.Topic() != "zigbee2mqtt/doorbell" || string(msg.Payload()) != `{"action":"single"}` || !msg.Retained() || msg.Qos() != 1 {
+		t.Errorf("got topic %q payload %q retained %v qos %d", msg.Topic(), msg.Payload(), msg.Retained(), msg.Qos())
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// one reading to watch per device, alerting once when it falls below
+// Threshold and only rearming when it's back to Threshold+Hysteresis, so a
+// value hovering around the line doesn't send an alert every message
+type levelWatch struct {
+	// the event's action, and how the reading is described in messages
+	Name      string
+	Label     string
+	Unit      string
+	Threshold int
+	// how far above Threshold a reading must recover before alerting again
+	Hysteresis int
+	low        map[string]bool
+}
+
+// the alert, if any, for a reading from the device on topic. a zero
+// reading means the message didn't carry one
+func (w *levelWatch) check(topic string, value uint16) (Event, bool) {
+	if w.Threshold <= 0 || value == 0 {
+		return Event{}, false
+	}
+	if w.low == nil {
+		w.low = make(map[string]bool)
+	}
+	v := int(value)
+	if v < w.Threshold && !w.low[topic] {
+		w.low[topic] = true
+		slog.Warn(w.Label+" low", "topic", topic, w.Name, v)
+		return Event{
+			Topic:  topic,
+			Action: w.Name,
+			Time:   time.Now(),
+			Text:   fmt.Sprintf("doorbell %s low: %d%s (%s)", w.Label, v, w.Unit, topic),
+		}, true
+	}
+	if v >= w.Threshold+w.Hysteresis && w.low[topic] {
+		w.low[topic] = false
+		slog.Info(w.Label+" recovered", "topic", topic, w.Name, v)
+	}
+	return Event{}, false
+}
+
+// battery and link quality alerts for every device
+type monitor struct {
+	battery levelWatch
+	link    levelWatch
+}
+
+func new_monitor(cfg config) *monitor {
+	return &monitor{
+		battery: levelWatch{Name: "battery", Label: "battery", Unit: "%", Threshold: cfg.BatteryThreshold, Hysteresis: cfg.BatteryHysteresis},
+		link:    levelWatch{Name: "linkquality", Label: "link quality", Threshold: cfg.LinkThreshold, Hysteresis: cfg.LinkHysteresis},
+	}
+}
+
+// take up new thresholds, remembering which devices have already been
+// alerted about
+func (m *monitor) retune(cfg config) {
+	m.battery.Threshold, m.battery.Hysteresis = cfg.BatteryThreshold, cfg.BatteryHysteresis
+	m.link.Threshold, m.link.Hysteresis = cfg.LinkThreshold, cfg.LinkHysteresis
+}
+
+// alerts prompted by one message
+func (m *monitor) check(topic string, msg ButtonMessage) []Event {
+	var alerts []Event
+	if ev, ok := m.battery.check(topic, msg.Battery); ok {
+		ev.Battery, ev.Linkquality = msg.Battery, msg.Linkquality
+		alerts = append(alerts, ev)
+	}
+	if ev, ok := m.link.check(topic, msg.Linkquality); ok {
+		ev.Battery, ev.Linkquality = msg.Battery, msg.Linkquality
+		alerts = append(alerts, ev)
+	}
+	return alerts
+}
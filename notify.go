@@ -0,0 +1,614 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// shared by every notifier. there's deliberately no client-wide timeout:
+// each delivery carries its own deadline on the request context
+var http_client = &http.Client{Transport: proxy_transport("")}
+
+// a transport that goes through proxy when one is given, and otherwise
+// honours HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+func proxy_transport(proxy string) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	if proxy != "" {
+		proxy_url, err := url.Parse(proxy)
+		if err != nil {
+			fatal("bad proxy URL", "proxy", proxy, "err", err)
+		}
+		transport.Proxy = http.ProxyURL(proxy_url)
+		slog.Info("sending notifications through proxy", "proxy", proxy_url.Redacted())
+	}
+	return transport
+}
+
+// a doorbell press, or anything else worth telling someone about
+type Event struct {
+	Topic  string `json:"topic"`
+	Action string `json:"action"`
+	// normal, rapid or combo
+	Class       string    `json:"class,omitempty"`
+	Battery     uint16    `json:"battery,omitempty"`
+	Linkquality uint16    `json:"linkquality,omitempty"`
+	Time        time.Time `json:"time"`
+	// the plain text message, which most notifiers send as it is
+	Text string `json:"text"`
+	// a camera still from when it happened, if one was taken
+	Snapshot *snapshot `json:"-"`
+}
+
+// somewhere to send a message when the doorbell rings
+type Notifier interface {
+	Name() string
+	// the URL deliveries go to, for reachability checks
+	Endpoint() string
+	// how long a delivery may take; zero means use the shared default
+	Timeout() time.Duration
+	Notify(ctx context.Context, ev Event) error
+}
+
+type SlackNotifier struct {
+	URL          string
+	DeliveryTime time.Duration
+	// per-action block kit templates; actions without one get plain text
+	Blocks map[string]*template.Template
+}
+
+// load the block kit template files named in -slack-blocks
+func load_slack_blocks(paths map[string]string) (map[string]*template.Template, error) {
+	blocks := make(map[string]*template.Template)
+	for action, path := range paths {
+		t, err := template.New(filepath.Base(path)).Funcs(template.FuncMap{
+			// so templates can drop values into JSON strings safely
+			"json": func(v interface{}) (string, error) {
+				b, err := json.Marshal(v)
+				return string(b), err
+			},
+		}).ParseFiles(path)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't load Slack blocks for %s: %v", action, err)
+		}
+		blocks[action] = t
+	}
+	return blocks, nil
+}
+
+func (s SlackNotifier) Name() string {
+	return "slack"
+}
+
+func (s SlackNotifier) Endpoint() string {
+	return s.URL
+}
+
+func (s SlackNotifier) Timeout() time.Duration {
+	return s.DeliveryTime
+}
+
+func (s SlackNotifier) Notify(ctx context.Context, ev Event) error {
+	t, ok := s.Blocks[ev.Action]
+	if !ok {
+		return slack_post(ctx, ev.Text, s.URL)
+	}
+	var rendered bytes.Buffer
+	if err := t.Execute(&rendered, ev); err != nil {
+		return fmt.Errorf("rendering blocks: %v", err)
+	}
+	// text stays alongside the blocks for notifications and old clients
+	payload, err := json.Marshal(map[string]interface{}{
+		"text":   ev.Text,
+		"blocks": json.RawMessage(rendered.Bytes()),
+	})
+	if err != nil {
+		return fmt.Errorf("blocks template for %s didn't produce valid JSON: %v", ev.Action, err)
+	}
+	return slack_send(ctx, payload, s.URL)
+}
+
+// posts to a Matrix room through the client-server API
+type MatrixNotifier struct {
+	Homeserver   string
+	Room         string
+	Token        string
+	DeliveryTime time.Duration
+}
+
+func (m MatrixNotifier) Name() string {
+	return "matrix"
+}
+
+func (m MatrixNotifier) Endpoint() string {
+	return m.Homeserver
+}
+
+func (m MatrixNotifier) Timeout() time.Duration {
+	return m.DeliveryTime
+}
+
+func (m MatrixNotifier) Notify(ctx context.Context, ev Event) error {
+	// the transaction ID only has to be unique for this access token
+	txn := fmt.Sprintf("doorbell-%d", time.Now().UnixNano())
+	endpoint := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/send/m.room.message/%s",
+		strings.TrimRight(m.Homeserver, "/"), url.PathEscape(m.Room), txn)
+	payload, _ := json.Marshal(map[string]string{
+		"msgtype": "m.text",
+		"body":    ev.Text,
+	})
+	code, body, err := send_json(ctx, http.MethodPut, endpoint, payload, map[string]string{
+		"Authorization": "Bearer " + m.Token,
+	})
+	if err != nil {
+		return err
+	}
+	if code/100 != 2 {
+		return fmt.Errorf("homeserver returned %d: %s", code, body)
+	}
+	return nil
+}
+
+// posts to a Discord channel webhook
+type DiscordNotifier struct {
+	URL          string
+	DeliveryTime time.Duration
+}
+
+func (d DiscordNotifier) Name() string {
+	return "discord"
+}
+
+func (d DiscordNotifier) Endpoint() string {
+	return d.URL
+}
+
+func (d DiscordNotifier) Timeout() time.Duration {
+	return d.DeliveryTime
+}
+
+func (d DiscordNotifier) Notify(ctx context.Context, ev Event) error {
+	payload, _ := json.Marshal(map[string]string{
+		"content": ev.Text,
+	})
+	code, body, err := send_json(ctx, http.MethodPost, d.URL, payload, nil)
+	if err != nil {
+		return err
+	}
+	if code/100 != 2 {
+		return fmt.Errorf("Discord returned %d: %s", code, body)
+	}
+	return nil
+}
+
+// posts the message as plain text to any URL, e.g. an ntfy topic
+type WebhookNotifier struct {
+	URL          string
+	DeliveryTime time.Duration
+}
+
+func (w WebhookNotifier) Name() string {
+	return "webhook " + w.URL
+}
+
+func (w WebhookNotifier) Endpoint() string {
+	return w.URL
+}
+
+func (w WebhookNotifier) Timeout() time.Duration {
+	return w.DeliveryTime
+}
+
+func (w WebhookNotifier) Notify(ctx context.Context, ev Event) error {
+	code, body, err := send_body(ctx, http.MethodPost, w.URL, "text/plain; charset=utf-8", []byte(ev.Text), nil)
+	if err != nil {
+		return err
+	}
+	if code/100 != 2 {
+		return fmt.Errorf("webhook returned %d: %s", code, body)
+	}
+	return nil
+}
+
+// posts the whole event as JSON, for anything that wants more than the text
+type JSONWebhookNotifier struct {
+	URL          string
+	DeliveryTime time.Duration
+}
+
+func (w JSONWebhookNotifier) Name() string {
+	return "json-webhook " + w.URL
+}
+
+func (w JSONWebhookNotifier) Endpoint() string {
+	return w.URL
+}
+
+func (w JSONWebhookNotifier) Timeout() time.Duration {
+	return w.DeliveryTime
+}
+
+func (w JSONWebhookNotifier) Notify(ctx context.Context, ev Event) error {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	code, body, err := send_json(ctx, http.MethodPost, w.URL, payload, nil)
+	if err != nil {
+		return err
+	}
+	if code/100 != 2 {
+		return fmt.Errorf("webhook returned %d: %s", code, body)
+	}
+	return nil
+}
+
+const telegram_api = "https://api.telegram.org"
+
+// sends through a Telegram bot to one chat
+type TelegramNotifier struct {
+	Token        string
+	Chat         string
+	DeliveryTime time.Duration
+}
+
+func (t TelegramNotifier) Name() string {
+	return "telegram"
+}
+
+// the token is part of every bot URL, so only the host is given out
+func (t TelegramNotifier) Endpoint() string {
+	return telegram_api
+}
+
+func (t TelegramNotifier) Timeout() time.Duration {
+	return t.DeliveryTime
+}
+
+func (t TelegramNotifier) Notify(ctx context.Context, ev Event) error {
+	if ev.Snapshot != nil {
+		return t.send_photo(ctx, ev)
+	}
+	payload, _ := json.Marshal(map[string]string{
+		"chat_id": t.Chat,
+		"text":    ev.Text,
+	})
+	code, body, err := send_json(ctx, http.MethodPost, fmt.Sprintf("%s/bot%s/sendMessage", telegram_api, t.Token), payload, nil)
+	if err != nil {
+		return t.redact(err)
+	}
+	if code/100 != 2 {
+		return fmt.Errorf("telegram returned %d: %s", code, body)
+	}
+	return nil
+}
+
+// the snapshot with the text as its caption
+func (t TelegramNotifier) send_photo(ctx context.Context, ev Event) error {
+	var form bytes.Buffer
+	w := multipart.NewWriter(&form)
+	w.WriteField("chat_id", t.Chat)
+	w.WriteField("caption", ev.Text)
+	part, err := w.CreateFormFile("photo", "snapshot"+image_extension(ev.Snapshot.ContentType))
+	if err != nil {
+		return err
+	}
+	part.Write(ev.Snapshot.Data)
+	w.Close()
+	code, body, err := send_body(ctx, http.MethodPost, fmt.Sprintf("%s/bot%s/sendPhoto", telegram_api, t.Token), w.FormDataContentType(), form.Bytes(), nil)
+	if err != nil {
+		return t.redact(err)
+	}
+	if code/100 != 2 {
+		return fmt.Errorf("telegram returned %d: %s", code, body)
+	}
+	return nil
+}
+
+// the client's errors quote the URL, token and all, and they end up in
+// the logs
+func (t TelegramNotifier) redact(err error) error {
+	if t.Token == "" {
+		return err
+	}
+	var url_err *url.Error
+	if errors.As(err, &url_err) {
+		url_err.URL = strings.ReplaceAll(url_err.URL, t.Token, "REDACTED")
+	}
+	if strings.Contains(err.Error(), t.Token) {
+		return errors.New(strings.ReplaceAll(err.Error(), t.Token, "REDACTED"))
+	}
+	return err
+}
+
+func image_extension(content_type string) string {
+	switch content_type {
+	case "image/png":
+		return ".png"
+	case "image/gif":
+		return ".gif"
+	}
+	return ".jpg"
+}
+
+const pushover_api = "https://api.pushover.net/1/messages.json"
+
+// pushes to a Pushover user or group through an application token
+type PushoverNotifier struct {
+	Token        string
+	User         string
+	DeliveryTime time.Duration
+}
+
+func (p PushoverNotifier) Name() string {
+	return "pushover"
+}
+
+func (p PushoverNotifier) Endpoint() string {
+	return pushover_api
+}
+
+func (p PushoverNotifier) Timeout() time.Duration {
+	return p.DeliveryTime
+}
+
+func (p PushoverNotifier) Notify(ctx context.Context, ev Event) error {
+	payload, _ := json.Marshal(map[string]string{
+		"token":   p.Token,
+		"user":    p.User,
+		"title":   "Doorbell",
+		"message": ev.Text,
+	})
+	code, body, err := send_json(ctx, http.MethodPost, pushover_api, payload, nil)
+	if err != nil {
+		return err
+	}
+	if code/100 != 2 {
+		return fmt.Errorf("pushover returned %d: %s", code, body)
+	}
+	return nil
+}
+
+// publishes to an ntfy topic URL, such as https://ntfy.sh/my-doorbell
+type NtfyNotifier struct {
+	URL          string
+	Token        string
+	DeliveryTime time.Duration
+}
+
+func (n NtfyNotifier) Name() string {
+	return "ntfy"
+}
+
+func (n NtfyNotifier) Endpoint() string {
+	return n.URL
+}
+
+func (n NtfyNotifier) Timeout() time.Duration {
+	return n.DeliveryTime
+}
+
+func (n NtfyNotifier) Notify(ctx context.Context, ev Event) error {
+	headers := map[string]string{"Title": "Doorbell", "Tags": "bell"}
+	if n.Token != "" {
+		headers["Authorization"] = "Bearer " + n.Token
+	}
+	code, body, err := send_body(ctx, http.MethodPost, n.URL, "text/plain; charset=utf-8", []byte(ev.Text), headers)
+	if err != nil {
+		return err
+	}
+	if code/100 != 2 {
+		return fmt.Errorf("ntfy returned %d: %s", code, body)
+	}
+	return nil
+}
+
+// a notifier that only hears about some events, from -notify-for
+type routedNotifier struct {
+	Notifier
+	// actions and press classes, e.g. single, battery or rapid
+	Events map[string]bool
+}
+
+// whether n should be told about ev
+func wants(n Notifier, ev Event) bool {
+	r, ok := n.(routedNotifier)
+	return !ok || r.Events[ev.Action] || r.Events[ev.Class]
+}
+
+// the name up to any URL, so every webhook is "webhook"
+func notifier_kind(n Notifier) string {
+	return strings.Fields(n.Name())[0]
+}
+
+// build the notifiers that have been configured
+func make_notifiers(cfg config) ([]Notifier, error) {
+	var notifiers []Notifier
+	if cfg.SlackURL != "" {
+		blocks, err := load_slack_blocks(cfg.SlackBlocks)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, SlackNotifier{
+			URL:          cfg.SlackURL,
+			DeliveryTime: cfg.SlackTimeout,
+			Blocks:       blocks,
+		})
+	}
+	if cfg.MatrixHomeserver != "" && cfg.MatrixRoom != "" {
+		notifiers = append(notifiers, MatrixNotifier{
+			Homeserver:   cfg.MatrixHomeserver,
+			Room:         cfg.MatrixRoom,
+			Token:        cfg.MatrixToken,
+			DeliveryTime: cfg.MatrixTimeout,
+		})
+	}
+	if cfg.DiscordURL != "" {
+		notifiers = append(notifiers, DiscordNotifier{URL: cfg.DiscordURL, DeliveryTime: cfg.DiscordTimeout})
+	}
+	for _, endpoint := range cfg.Webhooks {
+		notifiers = append(notifiers, WebhookNotifier{URL: endpoint, DeliveryTime: cfg.WebhookTimeout})
+	}
+	for _, endpoint := range cfg.JSONWebhooks {
+		notifiers = append(notifiers, JSONWebhookNotifier{URL: endpoint, DeliveryTime: cfg.WebhookTimeout})
+	}
+	if cfg.TelegramToken != "" && cfg.TelegramChat != "" {
+		notifiers = append(notifiers, TelegramNotifier{Token: cfg.TelegramToken, Chat: cfg.TelegramChat, DeliveryTime: cfg.TelegramTimeout})
+	}
+	if cfg.PushoverToken != "" && cfg.PushoverUser != "" {
+		notifiers = append(notifiers, PushoverNotifier{Token: cfg.PushoverToken, User: cfg.PushoverUser, DeliveryTime: cfg.PushoverTimeout})
+	}
+	if cfg.NtfyURL != "" {
+		notifiers = append(notifiers, NtfyNotifier{URL: cfg.NtfyURL, Token: cfg.NtfyToken, DeliveryTime: cfg.NtfyTimeout})
+	}
+	for i, n := range notifiers {
+		events, ok := cfg.NotifyFor[notifier_kind(n)]
+		if !ok {
+			continue
+		}
+		r := routedNotifier{Notifier: n, Events: make(map[string]bool)}
+		for _, event := range strings.Split(events, ",") {
+			r.Events[strings.TrimSpace(event)] = true
+		}
+		notifiers[i] = r
+	}
+	return notifiers, nil
+}
+
+// hands notifications to goroutines, never more than a fixed number at once
+// so a flood of presses can't open an unbounded number of connections
+type dispatcher struct {
+	slots    chan struct{}
+	fallback time.Duration
+	st       *status
+	// deliveries still going, for shutdown to wait on
+	inflight sync.WaitGroup
+}
+
+// a limit of zero or less means no limit
+func new_dispatcher(limit int, fallback time.Duration, st *status) *dispatcher {
+	d := &dispatcher{fallback: fallback, st: st}
+	if limit > 0 {
+		d.slots = make(chan struct{}, limit)
+	}
+	return d
+}
+
+// deliver in the background, dropping the notification if every slot is busy
+func (d *dispatcher) send(n Notifier, ev Event) {
+	if d.slots == nil {
+		d.inflight.Add(1)
+		go func() {
+			defer d.inflight.Done()
+			notify(n, ev, d.fallback, d.st)
+		}()
+		return
+	}
+	select {
+	case d.slots <- struct{}{}:
+		d.inflight.Add(1)
+		go func() {
+			defer d.inflight.Done()
+			defer func() { <-d.slots }()
+			notify(n, ev, d.fallback, d.st)
+		}()
+	default:
+		slog.Warn("dropping notification: too many in flight", "notifier", notifier_kind(n), "action", ev.Action)
+		d.st.dropped_notification()
+	}
+}
+
+// wait up to timeout for deliveries in flight to finish
+func (d *dispatcher) wait(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		d.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		slog.Warn("gave up waiting for notifications to finish")
+	}
+}
+
+// deliver a message through one notifier, bounded by its timeout
+func notify(n Notifier, ev Event, fallback time.Duration, st *status) {
+	timeout := n.Timeout()
+	if timeout <= 0 {
+		timeout = fallback
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	started := time.Now()
+	err := n.Notify(ctx, ev)
+	elapsed := time.Since(started).Round(time.Millisecond)
+	if err != nil {
+		slog.Warn("notification failed", "notifier", notifier_kind(n), "action", ev.Action, "duration", elapsed, "err", err)
+	} else {
+		slog.Info("notified", "notifier", notifier_kind(n), "action", ev.Action, "duration", elapsed)
+	}
+	st.notified(notifier_kind(n), err)
+}
+
+// send a JSON body with the shared client, returning the response status and body
+func send_json(ctx context.Context, method string, endpoint string, payload []byte, headers map[string]string) (int, []byte, error) {
+	return send_body(ctx, method, endpoint, "application/json", payload, headers)
+}
+
+// send a body of any type with the shared client
+func send_body(ctx context.Context, method string, endpoint string, content_type string, payload []byte, headers map[string]string) (int, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, bytes.NewBuffer(payload))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", content_type)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http_client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, nil, err
+	}
+	return resp.StatusCode, body, nil
+}
+
+// post a message to a Slack channel using a webhook
+func slack_post(ctx context.Context, message string, endpoint string) error {
+	postBody, _ := json.Marshal(map[string]string{
+		"text": message,
+	})
+	return slack_send(ctx, postBody, endpoint)
+}
+
+// post an already encoded webhook payload. failures come back as errors,
+// never exits: a Slack outage mustn't take the doorbell down with it
+func slack_send(ctx context.Context, payload []byte, endpoint string) error {
+	code, body, err := send_json(ctx, http.MethodPost, endpoint, payload, nil)
+	if err != nil {
+		return err
+	}
+	if code/100 != 2 {
+		return fmt.Errorf("Slack returned %d: %s", code, body)
+	}
+	slog.Debug("message from Slack", "body", string(body))
+	return nil
+}
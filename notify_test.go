@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// stand in for the network for the rest of a test
+func fake_transport(t *testing.T, f roundTripFunc) {
+	t.Helper()
+	was := http_client
+	http_client = &http.Client{Transport: f}
+	t.Cleanup(func() {
+		http_client = was
+	})
+}
+
+func TestTelegramErrorsHideToken(t *testing.T) {
+	const token = "123456:SECRET-token"
+	fake_transport(t, func(r *http.Request) (*http.Response, error) {
+		return nil, errors.New("connection refused")
+	})
+	n := TelegramNotifier{Token: token, Chat: "42"}
+	for name, ev := range map[string]Event{
+		"message": {Text: "ding"},
+		"photo":   {Text: "ding", Snapshot: &snapshot{ContentType: "image/jpeg", Data: []byte{0xff, 0xd8}}},
+	} {
+		err := n.Notify(context.Background(), ev)
+		if err == nil {
+			t.Fatalf("%s: no error from a failed request", name)
+		}
+		if strings.Contains(err.Error(), "SECRET") {
+			t.Errorf("%s: error gives the token away: %v", name, err)
+		}
+		if !strings.Contains(err.Error(), "connection refused") {
+			t.Errorf("%s: error lost the cause: %v", name, err)
+		}
+	}
+}
+
+// a Slack template that doesn't parse fails the load, so a reload with one
+// is turned down rather than taking the daemon with it
+func TestBadSlackBlocksFailTheLoad(t *testing.T) {
+	blocks := filepath.Join(t.TempDir(), "single.json")
+	if err := os.WriteFile(blocks, []byte(`[{"type":"section","text":{{.Text}]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := config{
+		SingleSound: "ding.wav",
+		DoubleSound: "ding.wav",
+		SlackURL:    "http://slack.example/hook",
+		SlackBlocks: map[string]string{"single": blocks},
+	}
+	if _, err := load_settings(cfg, nil); err == nil || !strings.Contains(err.Error(), "Slack blocks") {
+		t.Errorf("loaded with a broken template: %v", err)
+	}
+}
+
+// each notifier's own timeout flag reaches it
+func TestNotifierTimeouts(t *testing.T) {
+	cfg := config{
+		SlackURL:         "http://slack.example/hook",
+		SlackTimeout:     1 * time.Second,
+		MatrixHomeserver: "http://matrix.example",
+		MatrixRoom:       "!room",
+		MatrixTimeout:    2 * time.Second,
+		DiscordURL:       "http://discord.example/hook",
+		DiscordTimeout:   3 * time.Second,
+		Webhooks:         stringList{"http://hooks.example/text"},
+		JSONWebhooks:     stringList{"http://hooks.example/json"},
+		WebhookTimeout:   4 * time.Second,
+		TelegramToken:    "123:abc",
+		TelegramChat:     "42",
+		TelegramTimeout:  5 * time.Second,
+		PushoverToken:    "token",
+		PushoverUser:     "user",
+		PushoverTimeout:  6 * time.Second,
+		NtfyURL:          "http://ntfy.example/doorbell",
+		NtfyTimeout:      7 * time.Second,
+	}
+	want := map[string]time.Duration{
+		"slack":        1 * time.Second,
+		"matrix":       2 * time.Second,
+		"discord":      3 * time.Second,
+		"webhook":      4 * time.Second,
+		"json-webhook": 4 * time.Second,
+		"telegram":     5 * time.Second,
+		"pushover":     6 * time.Second,
+		"ntfy":         7 * time.Second,
+	}
+	notifiers, err := make_notifiers(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notifiers) != len(want) {
+		t.Fatalf("got %d notifiers, want %d", len(notifiers), len(want))
+	}
+	for _, n := range notifiers {
+		if got := n.Timeout(); got != want[notifier_kind(n)] {
+			t.Errorf("%s: timeout %v, want %v", n.Name(), got, want[notifier_kind(n)])
+		}
+	}
+}
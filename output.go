@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// somewhere a press's sound can go
+type output interface {
+	Name() string
+	// sound a playback, calling finished exactly once when it's over
+	ring(pb *playback, finished func())
+}
+
+// the speaker on this machine
+type localOutput struct{}
+
+func (localOutput) Name() string {
+	return "local"
+}
+
+func (localOutput) ring(pb *playback, finished func()) {
+	pb.p.play(pb.gain, finished)
+}
+
+// republishes presses for satellite doorbells in other rooms, which
+// subscribe to Topic with -topic and play their own sound for the action
+type mqttOutput struct {
+	client mqtt.Client
+	Topic  string
+}
+
+func (o mqttOutput) Name() string {
+	return "mqtt " + o.Topic
+}
+
+// what satellites receive. it looks enough like a button's message
+// that a satellite needs nothing more than -topic to play it
+type ringMessage struct {
+	Action string    `json:"action"`
+	Source string    `json:"source_topic"`
+	Gain   float64   `json:"gain,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// doesn't wait for the satellites; they each play in their own time.
+// startup and shutdown sounds and announcements aren't presses, so
+// they stay local
+func (o mqttOutput) ring(pb *playback, finished func()) {
+	defer finished()
+	if pb.action == "" {
+		return
+	}
+	payload, _ := json.Marshal(ringMessage{Action: pb.action, Source: pb.topic, Gain: pb.gain, Time: time.Now()})
+	token := o.client.Publish(o.Topic, 1, false, payload)
+	if token.Wait() && token.Error() != nil {
+		slog.Warn("couldn't republish ring", "topic", o.Topic, "err", token.Error())
+	}
+}
+
+// the outputs named in -output, which is local unless told otherwise
+func make_outputs(cfg config, client mqtt.Client) ([]output, error) {
+	names := cfg.Outputs
+	if len(names) == 0 {
+		names = []string{"local"}
+	}
+	var outputs []output
+	for _, name := range names {
+		switch strings.TrimSpace(name) {
+		case "local":
+			outputs = append(outputs, localOutput{})
+		case "mqtt":
+			if cfg.RingTopic == "" {
+				return nil, fmt.Errorf("the mqtt output needs -ring-topic")
+			}
+			outputs = append(outputs, mqttOutput{client: client, Topic: cfg.RingTopic})
+		default:
+			return nil, fmt.Errorf("unrecognised output %q, want local or mqtt", name)
+		}
+	}
+	return outputs, nil
+}
+
+// sound pb on every output, calling finished once they're all done
+func ring_all(outputs []output, pb *playback, finished func()) {
+	remaining := int32(len(outputs))
+	for _, o := range outputs {
+		go o.ring(pb, func() {
+			if atomic.AddInt32(&remaining, -1) == 0 {
+				finished()
+			}
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a window of the day during which playing and notifying can be switched
+// independently, given on the command line as 22:00-07:00=notify. it can
+// be limited to some days, as in mon-fri@21:00-07:30=play,notify,volume=-20
+type policy struct {
+	// minutes after midnight; a window with End before Start runs past midnight
+	Start  int
+	End    int
+	Play   bool
+	Notify bool
+	// a bit per time.Weekday the window starts on; zero means every day
+	Days uint8
+	// decibels added to the chime while the window is active
+	Volume float64
+	// a different sound to play while the window is active
+	Sound string
+}
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+func parse_weekday(s string) (time.Weekday, error) {
+	for i, day := range weekdays {
+		if strings.EqualFold(s, day) {
+			return time.Weekday(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unrecognised day %q, want one of %s", s, strings.Join(weekdays, ","))
+}
+
+// parse days such as mon-fri or sat,sun into a bit per weekday.
+// ranges can wrap, so fri-mon is friday to monday
+func parse_days(s string) (uint8, error) {
+	var days uint8
+	for _, part := range strings.Split(s, ",") {
+		first, last, is_range := strings.Cut(strings.TrimSpace(part), "-")
+		from, err := parse_weekday(first)
+		if err != nil {
+			return 0, err
+		}
+		to := from
+		if is_range {
+			if to, err = parse_weekday(last); err != nil {
+				return 0, err
+			}
+		}
+		for d := from; ; d = (d + 1) % 7 {
+			days |= 1 << d
+			if d == to {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+func format_days(days uint8) string {
+	var names []string
+	for d, name := range weekdays {
+		if days&(1<<d) != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// parse a time of day as minutes after midnight
+func parse_clock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("bad time of day %q, want HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func format_clock(minutes int) string {
+	return fmt.Sprintf("%02d:%02d", minutes/60, minutes%60)
+}
+
+// whether the window covers the given time. the early hours of a window
+// running past midnight belong to the day it started on
+func (p policy) active(t time.Time) bool {
+	now := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	var in bool
+	if p.Start <= p.End {
+		in = now >= p.Start && now < p.End
+	} else if now >= p.Start {
+		in = true
+	} else if now < p.End {
+		in = true
+		day = (day + 6) % 7
+	}
+	return in && (p.Days == 0 || p.Days&(1<<day) != 0)
+}
+
+func (p policy) String() string {
+	var behaviours []string
+	if p.Play {
+		behaviours = append(behaviours, "play")
+	}
+	if p.Notify {
+		behaviours = append(behaviours, "notify")
+	}
+	if len(behaviours) == 0 {
+		behaviours = append(behaviours, "none")
+	}
+	if p.Volume != 0 {
+		behaviours = append(behaviours, fmt.Sprintf("volume=%g", p.Volume))
+	}
+	if p.Sound != "" {
+		behaviours = append(behaviours, "sound="+p.Sound)
+	}
+	days := ""
+	if p.Days != 0 {
+		days = format_days(p.Days) + "@"
+	}
+	return fmt.Sprintf("%s%s-%s=%s", days, format_clock(p.Start), format_clock(p.End), strings.Join(behaviours, ","))
+}
+
+// every -policy given, in order; the first active one wins
+type policyList []policy
+
+func (l *policyList) String() string {
+	var parts []string
+	for _, p := range *l {
+		parts = append(parts, p.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+func (l *policyList) Set(value string) error {
+	window, behaviours, found := strings.Cut(value, "=")
+	if !found {
+		return fmt.Errorf("policy %q needs the form [days@]HH:MM-HH:MM=play,notify", value)
+	}
+	var p policy
+	var err error
+	if days, clock, found := strings.Cut(window, "@"); found {
+		if p.Days, err = parse_days(days); err != nil {
+			return err
+		}
+		window = clock
+	}
+	start, end, found := strings.Cut(window, "-")
+	if !found {
+		return fmt.Errorf("policy window %q needs the form HH:MM-HH:MM", window)
+	}
+	if p.Start, err = parse_clock(start); err != nil {
+		return err
+	}
+	if p.End, err = parse_clock(end); err != nil {
+		return err
+	}
+	for _, b := range strings.Split(behaviours, ",") {
+		b = strings.TrimSpace(b)
+		if strings.HasPrefix(b, "volume=") {
+			db := strings.TrimPrefix(b, "volume=")
+			if p.Volume, err = strconv.ParseFloat(db, 64); err != nil {
+				return fmt.Errorf("policy volume %q should be a number of decibels", db)
+			}
+			continue
+		}
+		if strings.HasPrefix(b, "sound=") {
+			p.Sound = strings.TrimPrefix(b, "sound=")
+			continue
+		}
+		switch b {
+		case "play":
+			p.Play = true
+		case "notify":
+			p.Notify = true
+		case "none":
+		default:
+			return fmt.Errorf("unrecognised policy behaviour %q", b)
+		}
+	}
+	*l = append(*l, p)
+	return nil
+}
+
+// the policy in force at the given time and its index, or -1 and one
+// that plays and notifies when no window is active
+func (l policyList) current(t time.Time) (policy, int) {
+	for i, p := range l {
+		if p.active(t) {
+			return p, i
+		}
+	}
+	return policy{Play: true, Notify: true}, -1
+}
+
+// what to do at the given time. outside every window both happen
+func (l policyList) at(t time.Time) (play bool, notify bool) {
+	p, _ := l.current(t)
+	return p.Play, p.Notify
+}
+
+// the effective behaviour, as published on -mode-topic
+const (
+	mode_normal = "normal"
+	// a policy has switched the chime off
+	mode_quiet = "quiet"
+	// do not disturb has been switched on at runtime
+	mode_dnd = "dnd"
+	// silenced for a while through the HTTP API
+	mode_muted = "muted"
+)
+
+func (l policyList) mode(t time.Time, dnd bool, muted bool) string {
+	if dnd {
+		return mode_dnd
+	}
+	if muted {
+		return mode_muted
+	}
+	if play, _ := l.at(t); !play {
+		return mode_quiet
+	}
+	return mode_normal
+}
+
+// parse an on or off switch, as sent to the do not disturb topic or endpoint
+func parse_switch(s string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "on", "true", "1", "yes":
+		return true, nil
+	case "off", "false", "0", "no":
+		return false, nil
+	}
+	return false, fmt.Errorf("want on or off, not %q", s)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// whether anyone's home, for -notify-when
+const (
+	presence_home    = "home"
+	presence_away    = "away"
+	presence_unknown = "unknown"
+	// -notify-when for a notifier that goes out either way, as if unset
+	presence_always = "always"
+)
+
+// who's in, from -presence topics and -presence-ping hosts. the house is
+// home while any of them is, and away once they've all said otherwise
+type presenceTracker struct {
+	mu sync.Mutex
+	// each source's latest word, keyed by topic or host
+	home map[string]bool
+	// when each pinged host last answered
+	seen map[string]time.Time
+}
+
+func new_presence() *presenceTracker {
+	return &presenceTracker{home: make(map[string]bool), seen: make(map[string]time.Time)}
+}
+
+func (p *presenceTracker) set(source string, home bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	before := p.state_locked()
+	if was, ok := p.home[source]; ok && was == home {
+		return
+	}
+	p.home[source] = home
+	slog.Info("presence", "source", source, "home", home)
+	if after := p.state_locked(); after != before {
+		slog.Info("house presence changed", "from", before, "to", after)
+	}
+}
+
+// home, away, or unknown before any source has reported
+func (p *presenceTracker) state() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.state_locked()
+}
+
+func (p *presenceTracker) state_locked() string {
+	if len(p.home) == 0 {
+		return presence_unknown
+	}
+	for _, home := range p.home {
+		if home {
+			return presence_home
+		}
+	}
+	return presence_away
+}
+
+// each source and whether it's home, for /status
+func (p *presenceTracker) sources() map[string]bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sources := make(map[string]bool, len(p.home))
+	for source, home := range p.home {
+		sources[source] = home
+	}
+	return sources
+}
+
+// whether a notifier with this -notify-when should go out now. not
+// knowing counts as away, so a tracker that has gone quiet never stops
+// notifications that are only meant for when nobody's in
+func (p *presenceTracker) allows(when string) bool {
+	switch when {
+	case presence_home:
+		return p.state() == presence_home
+	case presence_away:
+		return p.state() != presence_home
+	}
+	return true
+}
+
+// follow a topic carrying one person's or device's presence
+func (p *presenceTracker) handler(topic string) mqtt.MessageHandler {
+	return func(client mqtt.Client, msg mqtt.Message) {
+		home, err := parse_presence(msg.Payload())
+		if err != nil {
+			slog.Warn("ignoring presence message", "topic", msg.Topic(), "err", err)
+			return
+		}
+		p.set(topic, home)
+	}
+}
+
+// ping hosts every interval. phones drop off the network to save power,
+// so a host that has answered before only counts as away once it's been
+// silent for timeout. closing stop cancels any pings still waiting for an
+// answer, and finished is told once they've all returned
+func (p *presenceTracker) ping(hosts []string, interval time.Duration, timeout time.Duration, stop <-chan struct{}, finished chan<- bool) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var checks sync.WaitGroup
+	round := func() {
+		for _, host := range hosts {
+			checks.Add(1)
+			go func(host string) {
+				defer checks.Done()
+				p.check(ctx, host, timeout)
+			}(host)
+		}
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	round()
+	for {
+		select {
+		case <-ticker.C:
+			round()
+		case <-stop:
+			cancel()
+			checks.Wait()
+			finished <- true
+			return
+		}
+	}
+}
+
+// sends one ping, failing if there's no answer. a variable so tests can
+// answer for hosts that aren't there
+var ping_host = func(ctx context.Context, host string) error {
+	return exec.CommandContext(ctx, "ping", "-c", "1", "-W", "2", host).Run()
+}
+
+func (p *presenceTracker) check(ctx context.Context, host string, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	err := ping_host(ctx, host)
+	// stopped rather than unanswered, which says nothing about the host
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return
+	}
+	p.mu.Lock()
+	if err == nil {
+		p.seen[host] = time.Now()
+	}
+	last, ever := p.seen[host]
+	p.mu.Unlock()
+	var not_run *exec.Error
+	if errors.As(err, &not_run) {
+		slog.Warn("couldn't run ping", "host", host, "err", err)
+	} else if err != nil {
+		slog.Debug("no answer to ping", "host", host, "err", err)
+	}
+	p.set(host, ever && time.Since(last) < timeout)
+}
+
+// presence payloads as the usual trackers send them: Home Assistant's
+// home and not_home, the on/off and true/false of switches and sensors,
+// or JSON with a presence, occupancy or state field like zigbee2mqtt's
+func parse_presence(payload []byte) (bool, error) {
+	text := strings.TrimSpace(string(payload))
+	if strings.HasPrefix(text, "{") {
+		var fields map[string]interface{}
+		if err := json.Unmarshal([]byte(text), &fields); err != nil {
+			return false, err
+		}
+		found := false
+		for _, key := range []string{"presence", "occupancy", "state"} {
+			if v, ok := fields[key]; ok {
+				text, found = fmt.Sprint(v), true
+				break
+			}
+		}
+		if !found {
+			return false, fmt.Errorf("no presence, occupancy or state field")
+		}
+	}
+	switch strings.ToLower(text) {
+	case "home", "present", "detected":
+		return true, nil
+	case "not_home", "away", "absent", "clear":
+		return false, nil
+	}
+	if on, err := parse_switch(text); err == nil {
+		return on, nil
+	}
+	return false, fmt.Errorf("want home or not_home, on or off, not %q", text)
+}
+
+// check -notify-when values before anything relies on them
+func validate_notify_when(when actionMap) error {
+	kinds := make([]string, 0, len(when))
+	for kind := range when {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		switch when[kind] {
+		case presence_home, presence_away, presence_always:
+		default:
+			return fmt.Errorf("-notify-when %s should be home, away or always, not %q", kind, when[kind])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"sync"
+	"testing"
+	"time"
+)
+
+// answer pings for whichever hosts are up
+func fake_ping(t *testing.T) (set_up func(host string, up bool)) {
+	t.Helper()
+	var mu sync.Mutex
+	up := make(map[string]bool)
+	was := ping_host
+	ping_host = func(ctx context.Context, host string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if !up[host] {
+			return errors.New("exit status 1")
+		}
+		return nil
+	}
+	t.Cleanup(func() {
+		ping_host = was
+	})
+	return func(host string, is_up bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		up[host] = is_up
+	}
+}
+
+func TestPresencePing(t *testing.T) {
+	set_up := fake_ping(t)
+	p := new_presence()
+	timeout := 50 * time.Millisecond
+
+	// never answered, so away
+	p.check(context.Background(), "phone", timeout)
+	if p.state() != presence_away {
+		t.Errorf("silent host: %s, want away", p.state())
+	}
+
+	set_up("phone", true)
+	p.check(context.Background(), "phone", timeout)
+	if p.state() != presence_home || !p.allows(presence_home) || p.allows(presence_away) {
+		t.Errorf("answering host: %s, want home", p.state())
+	}
+
+	// a dozing phone stays home until it's been quiet for the timeout
+	set_up("phone", false)
+	p.check(context.Background(), "phone", timeout)
+	if p.state() != presence_home {
+		t.Errorf("briefly silent host: %s, want home", p.state())
+	}
+	time.Sleep(timeout)
+	p.check(context.Background(), "phone", timeout)
+	if p.state() != presence_away || p.allows(presence_home) || !p.allows(presence_away) {
+		t.Errorf("long silent host: %s, want away", p.state())
+	}
+
+	// anyone home makes the house home
+	set_up("tablet", true)
+	p.check(context.Background(), "tablet", timeout)
+	if p.state() != presence_home {
+		t.Errorf("one of two hosts answering: %s, want home", p.state())
+	}
+	if sources := p.sources(); sources["phone"] || !sources["tablet"] {
+		t.Errorf("sources %v", sources)
+	}
+}
+
+func TestPresencePingLoop(t *testing.T) {
+	set_up := fake_ping(t)
+	set_up("phone", true)
+	p := new_presence()
+	stop := make(chan struct{})
+	finished := make(chan bool)
+	go p.ping([]string{"phone", "laptop"}, 10*time.Millisecond, time.Minute, stop, finished)
+	deadline := time.Now().Add(2 * time.Second)
+	for len(p.sources()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	// stopped before fake_ping's cleanup puts ping_host back
+	close(stop)
+	<-finished
+	if sources := p.sources(); !sources["phone"] || sources["laptop"] || len(sources) != 2 {
+		t.Errorf("sources %v, want phone home and laptop away", sources)
+	}
+}
+
+// stopping cancels a ping still waiting for an answer, without counting the
+// host as away
+func TestPresencePingStops(t *testing.T) {
+	was := ping_host
+	ping_host = func(ctx context.Context, host string) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	defer func() {
+		ping_host = was
+	}()
+	p := new_presence()
+	stop := make(chan struct{})
+	finished := make(chan bool)
+	go p.ping([]string{"phone"}, time.Minute, time.Minute, stop, finished)
+	close(stop)
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("still pinging after being stopped")
+	}
+	if sources := p.sources(); len(sources) != 0 {
+		t.Errorf("sources %v after a cancelled ping", sources)
+	}
+}
+
+// without ping installed every host counts as away rather than unknown
+func TestPresencePingMissing(t *testing.T) {
+	was := ping_host
+	ping_host = func(ctx context.Context, host string) error {
+		return exec.CommandContext(ctx, "doorbell-no-such-ping", host).Run()
+	}
+	defer func() {
+		ping_host = was
+	}()
+	p := new_presence()
+	p.check(context.Background(), "phone", time.Minute)
+	if p.state() != presence_away {
+		t.Errorf("got %s, want away", p.state())
+	}
+}
+
+func TestParsePresence(t *testing.T) {
+	for payload, want := range map[string]bool{
+		"home":                    true,
+		"not_home":                false,
+		" Away ":                  false,
+		"ON":                      true,
+		"false":                   false,
+		`{"presence":true}`:       true,
+		`{"occupancy":false}`:     false,
+		`{"state":"home","x":1}`:  true,
+		`{"presence":"detected"}`: true,
+		`{"state":"clear"}`:       false,
+	} {
+		got, err := parse_presence([]byte(payload))
+		if err != nil || got != want {
+			t.Errorf("%s: got %v, %v, want %v", payload, got, err, want)
+		}
+	}
+	for _, payload := range []string{"maybe", `{"battery":50}`, `{"state":`} {
+		if _, err := parse_presence([]byte(payload)); err == nil {
+			t.Errorf("%s: parsed without an error", payload)
+		}
+	}
+}
+
+func TestNotifyWhenUnknown(t *testing.T) {
+	p := new_presence()
+	// nothing reported yet counts as away, so away-only notifiers still go
+	if !p.allows(presence_away) || p.allows(presence_home) || !p.allows(presence_always) || !p.allows("") {
+		t.Error("unknown presence allows the wrong notifiers")
+	}
+}
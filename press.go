@@ -0,0 +1,36 @@
+package main
+
+import (
+	"time"
+)
+
+// kinds of press, each of which can have its own sound
+const (
+	press_normal = "normal"
+	// the same action again soon after the last one
+	press_rapid = "rapid"
+	// a different action soon after the last one, e.g. single then double
+	press_combo = "combo"
+)
+
+// sorts accepted presses by how they follow on from the one before
+type pressClassifier struct {
+	Window time.Duration
+
+	last_action string
+	last        time.Time
+}
+
+func (c *pressClassifier) classify(action string, now time.Time) string {
+	class := press_normal
+	if c.Window > 0 && !c.last.IsZero() && now.Sub(c.last) < c.Window {
+		if action == c.last_action {
+			class = press_rapid
+		} else {
+			class = press_combo
+		}
+	}
+	c.last_action = action
+	c.last = now
+	return class
+}
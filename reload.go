@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// a configuration with everything it needs loaded, ready for receiver to
+// switch to in one go
+type settings struct {
+	cfg       config
+	sounds    *soundSet
+	speech    *announcer
+	hooks     hookRunner
+	notifiers []Notifier
+}
+
+func load_settings(cfg config, client mqtt.Client) (settings, error) {
+	if len(cfg.SoundMap) == 0 && (cfg.SingleSound == "" || cfg.DoubleSound == "") {
+		return settings{}, fmt.Errorf("need to define %s and %s, or their sounds in -config", SINGLE_SOUND_ENV_VAR, DOUBLE_SOUND_ENV_VAR)
+	}
+	notifiers, err := make_notifiers(cfg)
+	if err != nil {
+		return settings{}, err
+	}
+	var speech *announcer
+	if cfg.Announce != "" {
+		if speech, err = new_announcer(cfg.TTSCommand, cfg.Announce, clamp_gain(cfg.Volume)); err != nil {
+			return settings{}, err
+		}
+	}
+	sounds, err := load_sounds(cfg)
+	if err != nil {
+		return settings{}, err
+	}
+	hooks := hookRunner{client: client, Hooks: cfg.Hooks, Timeout: cfg.HookTimeout}
+	return settings{cfg: cfg, sounds: sounds, speech: speech, hooks: hooks, notifiers: notifiers}, nil
+}
+
+// on SIGHUP read the environment and -config again over the original flags.
+// sounds are loaded here rather than in receiver so nothing waits on the
+// decoding, and a configuration that doesn't load leaves the old one running.
+// the broker, HTTP and Home Assistant settings only take effect on a restart
+func watch_reloads(client mqtt.Client, flags config, path string, set map[string]bool, st *status, reloads chan<- settings) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		slog.Info("received SIGHUP, reloading configuration")
+		cfg, err := resolve_config(flags, path, set)
+		if err != nil {
+			slog.Error("not reloading", "err", err)
+			continue
+		}
+		loaded, err := load_settings(cfg, client)
+		if err != nil {
+			slog.Error("not reloading", "err", err)
+			continue
+		}
+		added, removed := st.set_topics(cfg.Topics)
+		if len(removed) > 0 {
+			token := client.Unsubscribe(removed...)
+			token.Wait()
+			if token.Error() != nil {
+				slog.Warn("couldn't unsubscribe", "topics", removed, "err", token.Error())
+			}
+			slog.Info("unsubscribed", "topics", removed)
+		}
+		sub(client, added, byte(cfg.QoS))
+		reloads <- loaded
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// presses made up for -simulate, going through the same path as ones from
+// the broker so notifiers, policies and reloads can be tried without the
+// button. each line of in is an action or a JSON message such as
+// {"action":"single","battery":10}, optionally after a topic. presses stop
+// once stop is closed, and finished is told when the last one is in, so
+// the button channel can be closed safely
+func simulate(client mqtt.Client, listener mqtt.MessageHandler, in io.Reader, cfg config, st *status, stop <-chan struct{}, finished chan<- bool) {
+	press := func(topic string, payload []byte) {
+		if topic == "" {
+			slog.Warn("no topic for simulated press", "payload", string(payload))
+			return
+		}
+		slog.Info("simulated press", "topic", topic, "payload", string(payload))
+		listener(client, new_message(topic, payload, false, 0))
+	}
+	payload_for := func(action string) []byte {
+		return action_payload(cfg.ActionField, action)
+	}
+	// reading stdin can't be interrupted, so it's left to a goroutine of
+	// its own and only this one presses
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(in)
+		for scanner.Scan() {
+			select {
+			case lines <- scanner.Text():
+			case <-stop:
+				return
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			slog.Warn("stopped reading simulated presses", "err", err)
+		}
+	}()
+	var tick <-chan time.Time
+	if cfg.SimulateEvery > 0 {
+		ticker := time.NewTicker(cfg.SimulateEvery)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-stop:
+			finished <- true
+			return
+		case <-tick:
+			press(st.default_topic(), payload_for(cfg.SimulateAction))
+		case line, ok := <-lines:
+			if !ok {
+				// out of input, but -simulate-every may still be pressing
+				lines = nil
+				continue
+			}
+			simulate_line(strings.TrimSpace(line), st.default_topic(), press, payload_for)
+		}
+	}
+}
+
+// press for one line of -simulate input
+func simulate_line(line string, topic string, press func(string, []byte), payload_for func(string) []byte) {
+	if line == "" {
+		return
+	}
+	if strings.HasPrefix(line, "{") {
+		press(topic, []byte(line))
+		return
+	}
+	if t, message, _ := strings.Cut(line, " "); strings.HasPrefix(strings.TrimSpace(message), "{") {
+		press(t, []byte(strings.TrimSpace(message)))
+		return
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 1 {
+		press(topic, payload_for(fields[0]))
+	} else if len(fields) == 2 {
+		press(fields[0], payload_for(fields[1]))
+	} else {
+		slog.Warn("simulate wants [topic] action or [topic] {json}", "line", line)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestSimulate(t *testing.T) {
+	st := new_status()
+	st.set_topics([]string{"zigbee2mqtt/doorbell"})
+	cfg := config{ActionField: "action", SimulateEvery: time.Millisecond, SimulateAction: "single"}
+
+	var mu sync.Mutex
+	var stopped bool
+	var presses []string
+	listener := func(client mqtt.Client, msg mqtt.Message) {
+		mu.Lock()
+		defer mu.Unlock()
+		if stopped {
+			t.Errorf("pressed %s after being stopped", msg.Payload())
+		}
+		presses = append(presses, msg.Topic()+" "+string(msg.Payload()))
+	}
+	in := strings.NewReader("double\nporch/button single\n{\"action\":\"long\"}\nback/button {\"action\":\"hold\"}\n\n")
+	stop := make(chan struct{})
+	finished := make(chan bool)
+	go simulate(nil, listener, in, cfg, st, stop, finished)
+
+	time.Sleep(50 * time.Millisecond)
+	close(stop)
+	<-finished
+	mu.Lock()
+	stopped = true
+	mu.Unlock()
+	time.Sleep(10 * time.Millisecond)
+
+	want := []string{
+		`zigbee2mqtt/doorbell {"action":"double"}`,
+		`porch/button {"action":"single"}`,
+		`zigbee2mqtt/doorbell {"action":"long"}`,
+		`back/button {"action":"hold"}`,
+	}
+	var lines, ticks int
+	for _, p := range presses {
+		if p == `zigbee2mqtt/doorbell {"action":"single"}` {
+			ticks++
+		} else if lines < len(want) && p == want[lines] {
+			lines++
+		} else {
+			t.Errorf("unexpected press %s", p)
+		}
+	}
+	if lines != len(want) {
+		t.Errorf("got %d of the %d presses from input: %v", lines, len(want), presses)
+	}
+	if ticks == 0 {
+		t.Error("-simulate-every never pressed")
+	}
+}
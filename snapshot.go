@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// camera images are cut off past this size
+const max_snapshot_size = 10 << 20
+
+// how many snapshots /snapshot/ keeps serving, newest first
+const kept_snapshots = 20
+
+// a still from a camera, taken when the doorbell rang
+type snapshot struct {
+	ID          string
+	Data        []byte
+	ContentType string
+}
+
+// where to get a still for presses on each topic, from repeated
+// -snapshot [topic=]url flags. the entry without a topic covers the rest
+type snapshotSources map[string]string
+
+func (s snapshotSources) String() string {
+	var parts []string
+	for topic, source := range s {
+		parts = append(parts, topic+"="+source)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+// urls often have = in their query, so a topic is only split off when
+// the = comes before the scheme
+func (s snapshotSources) Set(value string) error {
+	topic, source := "", value
+	if eq, scheme := strings.Index(value, "="), strings.Index(value, "://"); eq >= 0 && (scheme < 0 || eq < scheme) {
+		topic, source = value[:eq], value[eq+1:]
+	}
+	if !strings.Contains(source, "://") {
+		return fmt.Errorf("snapshot source %q should be an http, https or rtsp URL", source)
+	}
+	s[topic] = source
+	return nil
+}
+
+func (s snapshotSources) source(topic string) string {
+	if source, ok := s[topic]; ok {
+		return source
+	}
+	return s[""]
+}
+
+// grab one image. http sources are fetched as they are; rtsp streams
+// have a frame pulled out by ffmpeg
+func fetch_snapshot(ctx context.Context, source string) ([]byte, string, error) {
+	if strings.HasPrefix(strings.ToLower(source), "rtsp://") {
+		cmd := exec.CommandContext(ctx, "ffmpeg", "-loglevel", "error", "-rtsp_transport", "tcp",
+			"-i", source, "-frames:v", "1", "-f", "image2", "-c:v", "mjpeg", "-")
+		data, err := cmd.Output()
+		if err != nil {
+			return nil, "", fmt.Errorf("ffmpeg: %v", err)
+		}
+		return data, "image/jpeg", nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := http_client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return nil, "", fmt.Errorf("camera returned %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, max_snapshot_size))
+	if err != nil {
+		return nil, "", err
+	}
+	content_type := resp.Header.Get("Content-Type")
+	if !strings.HasPrefix(content_type, "image/") {
+		content_type = http.DetectContentType(data)
+	}
+	return data, content_type, nil
+}
+
+// the last few snapshots, for the HTTP API to serve
+type snapshotStore struct {
+	mu     sync.Mutex
+	images []*snapshot
+}
+
+// IDs are random, since anyone with one can see the image
+func (s *snapshotStore) add(data []byte, content_type string) (*snapshot, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("snapshot ID: %v", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snap := &snapshot{ID: hex.EncodeToString(id), Data: data, ContentType: content_type}
+	s.images = append(s.images, snap)
+	if len(s.images) > kept_snapshots {
+		s.images = s.images[len(s.images)-kept_snapshots:]
+	}
+	return snap, nil
+}
+
+func (s *snapshotStore) get(id string) *snapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, snap := range s.images {
+		if snap.ID == id {
+			return snap
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// one row of the sound table. a press whose topic matches the MQTT filter
+// Topic (with + and # wildcards) and whose action matches the glob Action
+// plays Sound
+type soundRule struct {
+	Topic  string `json:"topic"`
+	Action string `json:"action"`
+	Sound  string `json:"sound"`
+	// decibels on top of the volume and any -gain for the action
+	Gain float64 `json:"gain,omitempty"`
+}
+
+func (r soundRule) String() string {
+	return fmt.Sprintf("%s:%s=%s", r.Topic, r.Action, r.Sound)
+}
+
+func (r soundRule) matches(topic string, action string) bool {
+	ok, _ := path.Match(r.Action, action)
+	return ok && topic_matches(r.Topic, topic)
+}
+
+// check a rule's patterns, so a typo is caught at startup rather than
+// silently never matching
+func (r soundRule) validate() error {
+	if r.Sound == "" {
+		return fmt.Errorf("no sound for %s:%s", r.Topic, r.Action)
+	}
+	if _, err := path.Match(r.Action, ""); err != nil {
+		return fmt.Errorf("bad action pattern %q: %v", r.Action, err)
+	}
+	if i := strings.Index(r.Topic, "#"); i >= 0 && i != len(r.Topic)-1 {
+		return fmt.Errorf("# must come last in topic %q", r.Topic)
+	}
+	return nil
+}
+
+// sound rules in the order given, from repeated -sound [topic:]action=path
+// flags. the first rule to match a press wins
+type soundMap []soundRule
+
+func (m *soundMap) String() string {
+	var parts []string
+	for _, r := range *m {
+		parts = append(parts, r.String())
+	}
+	return strings.Join(parts, ",")
+}
+
+func (m *soundMap) Set(value string) error {
+	pattern, sound, err := split_action_value(value)
+	if err != nil {
+		return err
+	}
+	r := soundRule{Topic: "#", Action: pattern, Sound: sound}
+	if i := strings.LastIndex(pattern, ":"); i >= 0 {
+		r.Topic, r.Action = pattern[:i], pattern[i+1:]
+	}
+	if err := r.validate(); err != nil {
+		return err
+	}
+	*m = append(*m, r)
+	return nil
+}
+
+// index of the first rule matching a press, or -1
+func (m soundMap) find(topic string, action string) int {
+	for i, r := range m {
+		if r.matches(topic, action) {
+			return i
+		}
+	}
+	return -1
+}
+
+// whether an MQTT topic filter, wildcards and all, matches a topic
+func topic_matches(filter string, topic string) bool {
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+		if i >= len(t) {
+			return false
+		}
+		if level != "+" && level != t[i] {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+// every sound one configuration plays, loaded together so a reload can swap
+// the whole lot at once
+type soundSet struct {
+	// the sound table, then the single and double sounds from the
+	// environment for whatever presses it doesn't cover
+	rules   soundMap
+	players []*player
+	// sounds for rapid and combo presses, and ones that replace the usual
+	// ones while a policy is active, keyed by the policy's index
+	class   map[string]*player
+	policy  map[int]*player
+	startup *player
+	// played on SIGINT or SIGTERM before exiting
+	shutdown *player
+}
+
+func load_sounds(cfg config) (*soundSet, error) {
+	// overlapping plays of one sound each need their own streamer,
+	// which only a buffered player can hand out
+	buffered := cfg.BufferSounds || cfg.Mixer
+	new_player := func(path string) *player {
+		return &player{
+			Path:        path,
+			Buffered:    buffered,
+			Wait:        cfg.SoundWait,
+			MaxDuration: cfg.MaxSoundDuration,
+			Volume:      clamp_gain(cfg.Volume),
+			Cache:       cfg.SoundCache,
+		}
+	}
+	s := &soundSet{
+		rules:  append(soundMap(nil), cfg.SoundMap...),
+		class:  make(map[string]*player),
+		policy: make(map[int]*player),
+	}
+	defaults := len(s.rules)
+	if cfg.SingleSound != "" {
+		s.rules = append(s.rules, soundRule{Topic: "#", Action: "single", Sound: cfg.SingleSound})
+	}
+	if cfg.DoubleSound != "" {
+		s.rules = append(s.rules, soundRule{Topic: "#", Action: "double", Sound: cfg.DoubleSound})
+	}
+	// each sound starts from the global -volume, or for the single and
+	// double defaults their own environment override, then any -gain for
+	// its action goes on top
+	volume_vars := map[string]string{"single": SINGLE_VOLUME_ENV_VAR, "double": DOUBLE_VOLUME_ENV_VAR}
+	for i, r := range s.rules {
+		p := new_player(r.Sound)
+		requested := cfg.Volume + cfg.Gains[r.Action] + r.Gain
+		if i >= defaults {
+			requested = env_float(volume_vars[r.Action], cfg.Volume) + cfg.Gains[r.Action]
+		}
+		p.Volume = clamp_gain(requested)
+		if p.Volume != requested {
+			slog.Warn("volume clamped", "rule", r.String(), "requested_db", requested, "db", p.Volume)
+		}
+		slog.Info("volume", "rule", r.String(), "db", p.Volume)
+		if err := p.init(); err != nil {
+			s.close()
+			return nil, fmt.Errorf("couldn't load sound for %s: %v", r, err)
+		}
+		s.players = append(s.players, p)
+	}
+	// extras that fail to load are left out rather than stopping everything
+	optional := func(what string, path string) *player {
+		if path == "" {
+			return nil
+		}
+		p := new_player(path)
+		if err := p.init(); err != nil {
+			slog.Warn("sound left out", "sound", what, "err", err)
+			return nil
+		}
+		return p
+	}
+	for class, path := range map[string]string{press_rapid: cfg.RapidSound, press_combo: cfg.ComboSound} {
+		if p := optional(class, path); p != nil {
+			s.class[class] = p
+		}
+	}
+	s.startup = optional("startup", cfg.StartupSound)
+	s.shutdown = optional("shutdown", cfg.ShutdownSound)
+	for i, pol := range cfg.Policies {
+		if p := optional("policy "+pol.String(), pol.Sound); p != nil {
+			s.policy[i] = p
+		}
+	}
+	return s, nil
+}
+
+// the player for a press, or nil when nothing in the table covers it
+func (s *soundSet) find(topic string, action string) *player {
+	i := s.rules.find(topic, action)
+	if i < 0 {
+		return nil
+	}
+	return s.players[i]
+}
+
+func (s *soundSet) close() {
+	for _, p := range s.players {
+		p.close()
+	}
+	for _, p := range s.class {
+		p.close()
+	}
+	for _, p := range s.policy {
+		p.close()
+	}
+	for _, p := range []*player{s.startup, s.shutdown} {
+		if p != nil {
+			p.close()
+		}
+	}
+}
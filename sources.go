@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/faiface/beep"
+)
+
+// how long a sound may take to download, or to turn into WAV with ffmpeg
+const fetch_timeout = 30 * time.Second
+
+// the most of a sound we'll download, so a URL pointing at the wrong thing
+// can't fill the disk. a doorbell chime is rarely more than a megabyte
+var max_sound_size int64 = 32 << 20
+
+// sounds given as http or https URLs rather than files
+func is_url(source string) bool {
+	lower := strings.ToLower(source)
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://")
+}
+
+// where downloaded sounds are kept unless -sound-cache says otherwise
+func default_sound_cache() string {
+	if dir, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(dir, "doorbell")
+	}
+	return filepath.Join(os.TempDir(), "doorbell-sounds")
+}
+
+// download a sound into cache, returning the file to play it from. a
+// copy from an earlier run is only fetched again if the server says it's
+// changed, and is used as it is when the server can't be reached
+func fetch_sound(source string, cache string) (string, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return "", fmt.Errorf("bad sound URL %s: %v", source, err)
+	}
+	sum := sha256.Sum256([]byte(source))
+	// the extension picks the decoder, so it's kept
+	local := filepath.Join(cache, hex.EncodeToString(sum[:8])+strings.ToLower(path.Ext(u.Path)))
+	cached, stat_err := os.Stat(local)
+	fallback := func(err error) (string, error) {
+		if stat_err == nil {
+			slog.Warn("couldn't refresh sound, using the cached copy", "url", u.Redacted(), "path", local, "err", err)
+			return local, nil
+		}
+		return "", fmt.Errorf("couldn't download %s: %v", u.Redacted(), err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), fetch_timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return "", err
+	}
+	if stat_err == nil {
+		req.Header.Set("If-Modified-Since", cached.ModTime().UTC().Format(http.TimeFormat))
+	}
+	resp, err := http_client.Do(req)
+	if err != nil {
+		return fallback(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && stat_err == nil {
+		slog.Debug("cached sound is up to date", "url", u.Redacted(), "path", local)
+		return local, nil
+	}
+	if resp.StatusCode/100 != 2 {
+		return fallback(fmt.Errorf("server returned %d", resp.StatusCode))
+	}
+	if resp.ContentLength > max_sound_size {
+		return fallback(fmt.Errorf("%d bytes is more than the %d a sound may be", resp.ContentLength, max_sound_size))
+	}
+	if err := os.MkdirAll(cache, 0o755); err != nil {
+		return fallback(err)
+	}
+	// written alongside and renamed into place, so a download cut short
+	// never replaces a good copy
+	tmp, err := os.CreateTemp(cache, ".download-*")
+	if err != nil {
+		return fallback(err)
+	}
+	defer os.Remove(tmp.Name())
+	// the length a server gives can be missing or wrong, so the copy is
+	// capped too
+	n, err := io.Copy(tmp, io.LimitReader(resp.Body, max_sound_size+1))
+	if err == nil && n > max_sound_size {
+		err = fmt.Errorf("more than the %d bytes a sound may be", max_sound_size)
+	}
+	if err != nil {
+		tmp.Close()
+		return fallback(err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fallback(err)
+	}
+	if err := os.Rename(tmp.Name(), local); err != nil {
+		return fallback(err)
+	}
+	// stamped with the server's time so the next If-Modified-Since matches it
+	if modified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		os.Chtimes(local, modified, modified)
+	}
+	slog.Info("downloaded sound", "url", u.Redacted(), "path", local)
+	return local, nil
+}
+
+// Ogg Vorbis and Opus have no decoder among our dependencies, so ffmpeg
+// turns them into a temporary WAV, deleted as soon as it's open
+func decode_transcoded(f *os.File) (beep.StreamSeekCloser, beep.Format, error) {
+	defer f.Close()
+	tmp, err := os.CreateTemp("", "doorbell-*.wav")
+	if err != nil {
+		return nil, beep.Format{}, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	ctx, cancel := context.WithTimeout(context.Background(), fetch_timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-loglevel", "error", "-y", "-i", "pipe:0", "-c:a", "pcm_s16le", tmp.Name())
+	cmd.Stdin = f
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, beep.Format{}, fmt.Errorf("ffmpeg: %v %s", err, strings.TrimSpace(stderr.String()))
+	}
+	wav, err := os.Open(tmp.Name())
+	if err != nil {
+		return nil, beep.Format{}, err
+	}
+	streamer, format, err := decode_wav(wav)
+	if err != nil {
+		wav.Close()
+	}
+	return streamer, format, err
+}
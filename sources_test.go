@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFetchSound(t *testing.T) {
+	sound := make_wav(wav_format_pcm, 16, 1, false, wav_samples)
+	modified := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	var requests, downloads int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !modified.After(since) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		downloads++
+		w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+		w.Write(sound)
+	}))
+	cache := t.TempDir()
+	source := server.URL + "/chimes/Ding.WAV"
+
+	local, err := fetch_sound(source, cache)
+	if err != nil {
+		t.Fatalf("first fetch: %v", err)
+	}
+	if filepath.Dir(local) != cache || filepath.Ext(local) != ".wav" {
+		t.Errorf("cached as %s", local)
+	}
+	if got, _ := os.ReadFile(local); !bytes.Equal(got, sound) {
+		t.Error("cached copy differs from the download")
+	}
+	if again, err := fetch_sound(source, cache); err != nil || again != local {
+		t.Errorf("second fetch: %s, %v", again, err)
+	}
+	if requests != 2 || downloads != 1 {
+		t.Errorf("%d requests and %d downloads, want 2 and 1", requests, downloads)
+	}
+
+	// offline, the cached copy is used; with nothing cached it's an error
+	server.Close()
+	if offline, err := fetch_sound(source, cache); err != nil || offline != local {
+		t.Errorf("offline fetch: %s, %v", offline, err)
+	}
+	if _, err := fetch_sound(server.URL+"/other.wav", cache); err == nil {
+		t.Error("fetched an uncached sound with the server down")
+	}
+}
+
+func TestFetchSoundTooLarge(t *testing.T) {
+	was := max_sound_size
+	max_sound_size = 1000
+	defer func() {
+		max_sound_size = was
+	}()
+	for name, handler := range map[string]http.HandlerFunc{
+		"with length": func(w http.ResponseWriter, r *http.Request) {
+			w.Write(make([]byte, 1001))
+		},
+		// flushing first sends it chunked, without a length
+		"without length": func(w http.ResponseWriter, r *http.Request) {
+			w.Write(make([]byte, 10))
+			w.(http.Flusher).Flush()
+			w.Write(make([]byte, 5000))
+		},
+	} {
+		server := httptest.NewServer(handler)
+		cache := t.TempDir()
+		if local, err := fetch_sound(server.URL+"/huge.wav", cache); err == nil {
+			t.Errorf("%s: fetched %s", name, local)
+		} else if !strings.Contains(err.Error(), "1000") {
+			t.Errorf("%s: error doesn't give the limit: %v", name, err)
+		}
+		if left, _ := os.ReadDir(cache); len(left) != 0 {
+			t.Errorf("%s: left %d files in the cache", name, len(left))
+		}
+		server.Close()
+	}
+}
+
+// a sound through ffmpeg and back, which needs ffmpeg installed
+func TestDecodeTranscoded(t *testing.T) {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		t.Skip("ffmpeg not installed")
+	}
+	dir := t.TempDir()
+	wav := filepath.Join(dir, "ding.wav")
+	samples := make([]float64, 44100/10)
+	for i := range samples {
+		samples[i] = 0.5
+	}
+	if err := os.WriteFile(wav, make_wav(wav_format_pcm, 16, 1, false, samples), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, extension := range []string{".ogg", ".opus"} {
+		encoded := filepath.Join(dir, "ding"+extension)
+		if out, err := exec.Command("ffmpeg", "-loglevel", "error", "-y", "-i", wav, encoded).CombinedOutput(); err != nil {
+			t.Skipf("ffmpeg can't write %s: %v %s", extension, err, out)
+		}
+		f, err := os.Open(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		streamer, format, err := decode_sound(encoded, f)
+		if err != nil {
+			t.Fatalf("%s: %v", extension, err)
+		}
+		// lossy codecs pad and resample, so only roughly the same length
+		if d := format.SampleRate.D(streamer.Len()); d < 80*time.Millisecond || d > 150*time.Millisecond {
+			t.Errorf("%s: decoded %v of sound, want about 100ms", extension, d)
+		}
+		streamer.Close()
+	}
+}
+
+// the temporary WAV handling around ffmpeg, with a stand-in that passes
+// what it's given straight through
+func TestDecodeTranscodedFakeFFmpeg(t *testing.T) {
+	bin := t.TempDir()
+	script := "#!/bin/sh\nfor last; do :; done\ncat > \"$last\"\n"
+	if err := os.WriteFile(filepath.Join(bin, "ffmpeg"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("TMPDIR", t.TempDir())
+
+	path := filepath.Join(t.TempDir(), "ding.ogg")
+	if err := os.WriteFile(path, make_wav(wav_format_pcm, 16, 1, false, wav_samples), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamer, _, err := decode_sound(path, f)
+	if err != nil {
+		t.Fatalf("decode_sound: %v", err)
+	}
+	defer streamer.Close()
+	if streamer.Len() != len(wav_samples) {
+		t.Errorf("got %d frames, want %d", streamer.Len(), len(wav_samples))
+	}
+	if left, _ := os.ReadDir(os.Getenv("TMPDIR")); len(left) != 0 {
+		t.Errorf("left %d temporary files behind", len(left))
+	}
+
+	// ffmpeg failing comes back as an error with what it said
+	if err := os.WriteFile(filepath.Join(bin, "ffmpeg"), []byte("#!/bin/sh\necho 'Invalid data found' >&2\nexit 1\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if f, err = os.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := decode_sound(path, f); err == nil || !strings.Contains(err.Error(), "Invalid data found") {
+		t.Errorf("failing ffmpeg gave %v", err)
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// how many battery readings to remember per device
+const battery_history_len = 50
+
+type batteryReading struct {
+	Time    time.Time `json:"time"`
+	Battery uint16    `json:"battery"`
+}
+
+// what we last heard from one device
+type deviceState struct {
+	Battery     uint16    `json:"battery"`
+	Linkquality uint16    `json:"linkquality"`
+	LastSeen    time.Time `json:"last_seen"`
+	// battery level each time it changed, oldest first
+	History []batteryReading `json:"history"`
+}
+
+// state written by receiver and read by the HTTP handlers
+type status struct {
+	mu           sync.Mutex
+	started      time.Time
+	last_message time.Time
+	devices      map[string]*deviceState
+	// notifications thrown away because the dispatcher was full
+	dropped_notifications int
+	// presses seen per action, wanted or not
+	presses    map[string]int
+	last_press time.Time
+	// deliveries per kind of notifier, e.g. slack or webhook
+	notify_successes map[string]int
+	notify_failures  map[string]int
+	// broker connections lost, and reconnected after the first
+	disconnects int
+	reconnects  int
+	// do not disturb, switched at runtime
+	dnd_on bool
+	// decibels every sound is turned up or down by at runtime
+	volume_offset float64
+	// the chime is silenced until then, from /mute
+	mute_end time.Time
+	// what doorbell is subscribed to, which a reload can change
+	subscribed []string
+	// who's home, for -notify-when
+	presence *presenceTracker
+	// camera stills taken for recent presses
+	snapshots *snapshotStore
+	// called with the new setting whenever do not disturb changes
+	dnd_watchers []func(bool)
+	// nudged whenever do not disturb or muting changes, so the mode is
+	// republished promptly
+	mode_changed chan struct{}
+	// told whenever muting starts, so the receiver can drop what a mute
+	// should silence, as it does for an ack
+	muted_now chan struct{}
+}
+
+func new_status() *status {
+	return &status{started: time.Now(), devices: make(map[string]*deviceState), presses: make(map[string]int), notify_successes: make(map[string]int), notify_failures: make(map[string]int), mode_changed: make(chan struct{}, 1), muted_now: make(chan struct{}, 1), snapshots: &snapshotStore{}, presence: new_presence()}
+}
+
+// note a message from the device publishing on topic
+func (s *status) saw(topic string, m ButtonMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.devices[topic]
+	if !ok {
+		d = &deviceState{}
+		s.devices[topic] = d
+	}
+	d.LastSeen = time.Now()
+	s.last_message = d.LastSeen
+	if m.Linkquality != 0 {
+		d.Linkquality = m.Linkquality
+	}
+	if m.Battery != 0 && m.Battery != d.Battery {
+		d.Battery = m.Battery
+		d.History = append(d.History, batteryReading{d.LastSeen, m.Battery})
+		if len(d.History) > battery_history_len {
+			d.History = d.History[len(d.History)-battery_history_len:]
+		}
+	}
+}
+
+// copy of every device's state, safe to use without the lock
+func (s *status) devices_snapshot() map[string]deviceState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]deviceState, len(s.devices))
+	for topic, d := range s.devices {
+		c := *d
+		c.History = append([]batteryReading(nil), d.History...)
+		out[topic] = c
+	}
+	return out
+}
+
+// how long we've been running, and how long since any device was heard
+// from. the age is negative if nothing has arrived yet
+func (s *status) ages() (uptime time.Duration, last_message time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	uptime = time.Since(s.started)
+	last_message = -1
+	if !s.last_message.IsZero() {
+		last_message = time.Since(s.last_message)
+	}
+	return uptime, last_message
+}
+
+func (s *status) dropped_notification() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dropped_notifications++
+}
+
+func (s *status) dropped() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped_notifications
+}
+
+// count a press, whether or not anything comes of it
+func (s *status) pressed(action string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.presses[action]++
+	s.last_press = time.Now()
+}
+
+// count a delivery through a kind of notifier, failed when err is set
+func (s *status) notified(kind string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.notify_failures[kind]++
+	} else {
+		s.notify_successes[kind]++
+	}
+}
+
+func (s *status) connection_lost() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.disconnects++
+}
+
+func (s *status) reconnected() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reconnects++
+}
+
+// counters for /metrics, copied so they can be used without the lock
+type metrics struct {
+	Presses              map[string]int
+	LastPress            time.Time
+	NotifySuccesses      map[string]int
+	NotifyFailures       map[string]int
+	DroppedNotifications int
+	Disconnects          int
+	Reconnects           int
+	Devices              map[string]deviceState
+}
+
+func (s *status) metrics() metrics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := metrics{
+		Presses:              copy_counts(s.presses),
+		LastPress:            s.last_press,
+		NotifySuccesses:      copy_counts(s.notify_successes),
+		NotifyFailures:       copy_counts(s.notify_failures),
+		DroppedNotifications: s.dropped_notifications,
+		Disconnects:          s.disconnects,
+		Reconnects:           s.reconnects,
+		Devices:              make(map[string]deviceState, len(s.devices)),
+	}
+	for topic, d := range s.devices {
+		c := *d
+		c.History = nil
+		m.Devices[topic] = c
+	}
+	return m
+}
+
+func (s *status) set_dnd(on bool) {
+	s.mu.Lock()
+	if on == s.dnd_on {
+		s.mu.Unlock()
+		return
+	}
+	s.dnd_on = on
+	slog.Info("do not disturb", "on", on)
+	s.nudge()
+	watchers := s.dnd_watchers
+	s.mu.Unlock()
+	for _, watch := range watchers {
+		watch(on)
+	}
+}
+
+// have watch called whenever do not disturb is switched
+func (s *status) watch_dnd(watch func(bool)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dnd_watchers = append(s.dnd_watchers, watch)
+}
+
+// tell publish_mode something's changed. the caller holds the lock
+func (s *status) nudge() {
+	select {
+	case s.mode_changed <- struct{}{}:
+	default:
+	}
+}
+
+func (s *status) dnd() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dnd_on
+}
+
+// silence the chime for d, or unmute when d is zero
+func (s *status) mute(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if d <= 0 {
+		s.mute_end = time.Time{}
+		slog.Info("unmuted")
+	} else {
+		s.mute_end = time.Now().Add(d)
+		slog.Info("muted", "until", s.mute_end.Format("15:04:05"))
+		select {
+		case s.muted_now <- struct{}{}:
+		default:
+		}
+	}
+	s.nudge()
+}
+
+// when muting ends, or zero if not muted
+func (s *status) muted_until() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Now().After(s.mute_end) {
+		return time.Time{}
+	}
+	return s.mute_end
+}
+
+func (s *status) muted() bool {
+	return !s.muted_until().IsZero()
+}
+
+func copy_counts(counts map[string]int) map[string]int {
+	c := make(map[string]int, len(counts))
+	for k, n := range counts {
+		c[k] = n
+	}
+	return c
+}
+
+// turn every sound up or down by db from now on, within the usual limits
+func (s *status) set_volume(db float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.volume_offset = clamp_gain(db)
+	slog.Info("volume adjusted", "db", s.volume_offset)
+}
+
+func (s *status) volume() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.volume_offset
+}
+
+// the button topics to subscribe to whenever we connect
+func (s *status) topics() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.subscribed...)
+}
+
+// where presses go when nothing says otherwise, such as those made up by
+// -simulate. empty once a reload has left no topics
+func (s *status) default_topic() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.subscribed) == 0 {
+		return ""
+	}
+	return s.subscribed[0]
+}
+
+// replace the button topics, reporting which are new and which have gone
+func (s *status) set_topics(topics []string) (added []string, removed []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := make(map[string]bool)
+	for _, t := range s.subscribed {
+		old[t] = true
+	}
+	for _, t := range topics {
+		if !old[t] {
+			added = append(added, t)
+		}
+		delete(old, t)
+	}
+	for _, t := range s.subscribed {
+		if old[t] {
+			removed = append(removed, t)
+		}
+	}
+	s.subscribed = append([]string(nil), topics...)
+	return added, removed
+}
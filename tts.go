@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/faiface/beep"
+)
+
+// how long the speech command gets to render one announcement
+const speech_timeout = 10 * time.Second
+
+// spoken announcements, rendered by a text to speech command that reads
+// text on stdin and writes a WAV file to stdout, such as espeak-ng or piper
+type announcer struct {
+	Command []string
+	Text    *template.Template
+	// as for player
+	Volume float64
+}
+
+// what the -announce template can refer to
+type announcement struct {
+	ButtonMessage
+	Topic string
+	// normal, rapid or combo
+	Class string
+	Time  time.Time
+}
+
+func new_announcer(command string, text string, volume float64) (*announcer, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("no text to speech command")
+	}
+	tmpl, err := template.New("announce").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("bad announcement template: %v", err)
+	}
+	return &announcer{Command: args, Text: tmpl, Volume: volume}, nil
+}
+
+// speak the announcement for a press into a player ready to go
+func (a *announcer) render(data announcement) (*player, error) {
+	var text bytes.Buffer
+	if err := a.Text.Execute(&text, data); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), speech_timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, a.Command[0], a.Command[1:]...)
+	cmd.Stdin = &text
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	wav, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v %s", a.Command[0], err, strings.TrimSpace(stderr.String()))
+	}
+	streamer, format, err := decode_wav(nopCloser{bytes.NewReader(wav)})
+	if err != nil {
+		return nil, fmt.Errorf("%s output: %v", a.Command[0], err)
+	}
+	buffer := beep.NewBuffer(format)
+	buffer.Append(streamer)
+	streamer.Close()
+	return &player{Path: "announcement", Buffered: true, Volume: a.Volume, buffer: buffer, format: format}, nil
+}
+
+// a bytes.Reader with nothing to close, for decode_wav
+type nopCloser struct {
+	*bytes.Reader
+}
+
+func (nopCloser) Close() error { return nil }
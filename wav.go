@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/faiface/beep"
+	"io"
+	"math"
+)
+
+// WAVE format tags we can decode
+const (
+	wav_format_pcm        = 1
+	wav_format_float      = 3
+	wav_format_extensible = 0xfffe
+)
+
+// a WAV decoder covering what beep's own doesn't: 32-bit integer and
+// 32/64-bit float samples. it also always reads whole frames, where beep's
+// decoder can lose alignment on a short read and turn 24-bit audio into noise
+type wavDecoder struct {
+	r          io.ReadSeekCloser
+	float      bool
+	bits       int
+	channels   int
+	frame_size int
+	data_start int64
+	frames     int
+	pos        int
+	buf        []byte
+	err        error
+}
+
+// read the RIFF header and chunks up to the start of the sample data
+func decode_wav(r io.ReadSeekCloser) (beep.StreamSeekCloser, beep.Format, error) {
+	var riff struct {
+		Mark [4]byte
+		Size uint32
+		Wave [4]byte
+	}
+	if err := binary.Read(r, binary.LittleEndian, &riff); err != nil {
+		return nil, beep.Format{}, fmt.Errorf("wav: reading header: %v", err)
+	}
+	if string(riff.Mark[:]) != "RIFF" || string(riff.Wave[:]) != "WAVE" {
+		return nil, beep.Format{}, errors.New("wav: not a RIFF WAVE file")
+	}
+
+	d := &wavDecoder{r: r}
+	var sample_rate uint32
+	have_format := false
+	for {
+		var chunk struct {
+			ID   [4]byte
+			Size uint32
+		}
+		if err := binary.Read(r, binary.LittleEndian, &chunk); err != nil {
+			return nil, beep.Format{}, fmt.Errorf("wav: no data chunk: %v", err)
+		}
+		switch string(chunk.ID[:]) {
+		case "fmt ":
+			body := make([]byte, chunk.Size)
+			if _, err := io.ReadFull(r, body); err != nil || len(body) < 16 {
+				return nil, beep.Format{}, errors.New("wav: short format chunk")
+			}
+			tag := binary.LittleEndian.Uint16(body[0:])
+			d.channels = int(binary.LittleEndian.Uint16(body[2:]))
+			sample_rate = binary.LittleEndian.Uint32(body[4:])
+			d.frame_size = int(binary.LittleEndian.Uint16(body[12:]))
+			d.bits = int(binary.LittleEndian.Uint16(body[14:]))
+			if tag == wav_format_extensible {
+				if len(body) < 26 {
+					return nil, beep.Format{}, errors.New("wav: short extensible format chunk")
+				}
+				// the sub format GUID leads with the plain format tag
+				tag = binary.LittleEndian.Uint16(body[24:])
+			}
+			switch {
+			case tag == wav_format_pcm && (d.bits == 8 || d.bits == 16 || d.bits == 24 || d.bits == 32):
+			case tag == wav_format_float && (d.bits == 32 || d.bits == 64):
+				d.float = true
+			default:
+				return nil, beep.Format{}, fmt.Errorf("wav: unsupported format %d with %d bits per sample", tag, d.bits)
+			}
+			if d.channels < 1 || d.frame_size != d.channels*d.bits/8 {
+				return nil, beep.Format{}, errors.New("wav: inconsistent channel count and frame size")
+			}
+			have_format = true
+			if chunk.Size%2 != 0 {
+				r.Seek(1, io.SeekCurrent)
+			}
+		case "data":
+			if !have_format {
+				return nil, beep.Format{}, errors.New("wav: data chunk before format chunk")
+			}
+			start, err := r.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return nil, beep.Format{}, err
+			}
+			d.data_start = start
+			// streamed WAVs, such as some TTS output, are written before
+			// their length is known and carry 0 or 0xffffffff instead, and
+			// a file cut short holds less than it says. either way only
+			// what's actually there is played
+			size := int64(chunk.Size)
+			if end, err := r.Seek(0, io.SeekEnd); err == nil {
+				if size == 0 || size == math.MaxUint32 || size > end-start {
+					size = end - start
+				}
+				if _, err := r.Seek(start, io.SeekStart); err != nil {
+					return nil, beep.Format{}, err
+				}
+			}
+			d.frames = int(size) / d.frame_size
+			d.buf = make([]byte, 512*d.frame_size)
+			precision := d.bits / 8
+			if precision > 4 {
+				precision = 4
+			}
+			format := beep.Format{
+				SampleRate:  beep.SampleRate(sample_rate),
+				NumChannels: d.channels,
+				Precision:   precision,
+			}
+			return d, format, nil
+		default:
+			if _, err := r.Seek(int64(chunk.Size+chunk.Size%2), io.SeekCurrent); err != nil {
+				return nil, beep.Format{}, err
+			}
+		}
+	}
+}
+
+// one sample scaled to [-1, 1]
+func (d *wavDecoder) sample(b []byte) float64 {
+	switch {
+	case d.float && d.bits == 32:
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(b)))
+	case d.float:
+		return math.Float64frombits(binary.LittleEndian.Uint64(b))
+	case d.bits == 8:
+		// 8-bit WAV is the only unsigned one
+		return (float64(b[0]) - 128) / 128
+	case d.bits == 16:
+		return float64(int16(binary.LittleEndian.Uint16(b))) / (1 << 15)
+	case d.bits == 24:
+		// shift up then back down to sign extend
+		v := int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24) >> 8
+		return float64(v) / (1 << 23)
+	default:
+		return float64(int32(binary.LittleEndian.Uint32(b))) / (1 << 31)
+	}
+}
+
+func (d *wavDecoder) Stream(samples [][2]float64) (int, bool) {
+	if d.err != nil || d.pos >= d.frames {
+		return 0, false
+	}
+	n := len(samples)
+	if n > d.frames-d.pos {
+		n = d.frames - d.pos
+	}
+	if n > len(d.buf)/d.frame_size {
+		n = len(d.buf) / d.frame_size
+	}
+	got, err := io.ReadFull(d.r, d.buf[:n*d.frame_size])
+	n = got / d.frame_size
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// the data ran out early, which is the end of the sound rather
+		// than a failure
+		d.frames = d.pos + n
+	} else if err != nil {
+		d.err = err
+	}
+	width := d.bits / 8
+	for i := 0; i < n; i++ {
+		frame := d.buf[i*d.frame_size:]
+		left := d.sample(frame)
+		right := left
+		if d.channels > 1 {
+			right = d.sample(frame[width:])
+		}
+		samples[i] = [2]float64{left, right}
+	}
+	d.pos += n
+	return n, n > 0
+}
+
+func (d *wavDecoder) Err() error {
+	return d.err
+}
+
+func (d *wavDecoder) Len() int {
+	return d.frames
+}
+
+func (d *wavDecoder) Position() int {
+	return d.pos
+}
+
+func (d *wavDecoder) Seek(p int) error {
+	if p < 0 || p > d.frames {
+		return fmt.Errorf("wav: seek position %d out of range [0, %d]", p, d.frames)
+	}
+	if _, err := d.r.Seek(d.data_start+int64(p*d.frame_size), io.SeekStart); err != nil {
+		return err
+	}
+	d.pos = p
+	d.err = nil
+	return nil
+}
+
+func (d *wavDecoder) Close() error {
+	return d.r.Close()
+}